@@ -0,0 +1,364 @@
+package hamtcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/bits"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+)
+
+// Marks the root of a chunked value, so it's told apart from other links
+const chunkedValueKey = "__CHUNKED_VALUE_HAMT_KEY__"
+
+const (
+	// A threshold suited to most values, see WithChunking to enable chunking
+	DefaultChunkThreshold = 1 << 20
+	DefaultChunkSize      = 256 << 10
+)
+
+// Most links held by a node of the chunks tree, larger values get more levels
+const chunkLinksPerNode = 1024
+
+// Chunks stored between flushes of buffering storages, bounding their memory
+const chunkFlushInterval = 64
+
+var ErrHAMTInvalidChunkedValue = errors.New("Invalid chunked value")
+
+// Chunker splits the data read from r, the returned function gives the chunks
+// in order and then io.EOF. Chunks must be new slices, they're kept as is.
+type Chunker func(r io.Reader) func() ([]byte, error)
+
+// FixedSizeChunker splits data into chunks of size bytes, the last one being shorter
+func FixedSizeChunker(size int) Chunker {
+	if size < 1 {
+		size = DefaultChunkSize
+	}
+
+	return func(r io.Reader) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			chunk := make([]byte, size)
+			n, err := io.ReadFull(r, chunk)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			if n == 0 && err == nil {
+				err = io.EOF
+			}
+			return chunk[:n], err
+		}
+	}
+}
+
+// ContentDefinedChunker splits data where its content says so, with a gear
+// rolling hash. Inserting bytes in a value only changes the chunks around
+// them, so new versions of large values share most of their blocks.
+// Chunks are between min and max bytes, avg bytes on average.
+func ContentDefinedChunker(min, avg, max int) Chunker {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if avg < 2 {
+		avg = 2
+	}
+
+	// Cut when the top bits of the hash are zero, they depend on the last 64 bytes
+	mask := ^uint64(0) << (64 - (bits.Len(uint(avg)) - 1))
+
+	return func(r io.Reader) func() ([]byte, error) {
+		reader := bufio.NewReader(r)
+
+		return func() ([]byte, error) {
+			chunk := make([]byte, 0, min)
+			var hash uint64
+
+			for len(chunk) < max {
+				b, err := reader.ReadByte()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+
+				chunk = append(chunk, b)
+				hash = hash<<1 + gearTable[b]
+				if len(chunk) >= min && hash&mask == 0 {
+					break
+				}
+			}
+
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+			return chunk, nil
+		}
+	}
+}
+
+// gearTable holds a fixed random value per byte, chunk boundaries depend on it
+var gearTable = func() (table [256]uint64) {
+	// splitmix64, any seed would do as long as it never changes
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// storeChunked stores the data read from r as chunks linked by a tree of
+// nodes, each holding up to chunkLinksPerNode links to chunks or to the nodes
+// of the level below, and returns the root link with the size of the data
+// Only the chunk being stored is held in memory, along with a node per level,
+// unless the storage buffers writes
+func (hc *HAMTContainer) storeChunked(lnkCtx ipld.LinkContext, r io.Reader) (ipld.Link, int64, error) {
+	next := hc.chunker(r)
+
+	// levels[0] holds links to chunks, levels[i] links to nodes of levels[i-1]
+	levels := [][]ipld.Link{nil}
+	var size int64
+	for {
+		chunk, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		lnk, err := hc.linkSystem.Store(lnkCtx, hc.linkProto, basicnode.NewBytes(chunk))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		levels[0] = append(levels[0], lnk)
+		size += int64(len(chunk))
+
+		if len(levels[0])%chunkFlushInterval == 0 {
+			if err := storage.Flush(context.Background(), hc.storage); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// Full nodes are stored right away, linked by the level above
+		for i := 0; len(levels[i]) == chunkLinksPerNode; i++ {
+			if i+1 == len(levels) {
+				levels = append(levels, nil)
+			}
+
+			lnk, err := hc.storeChunkLinks(lnkCtx, levels[i])
+			if err != nil {
+				return nil, 0, err
+			}
+			levels[i+1] = append(levels[i+1], lnk)
+			levels[i] = nil
+		}
+	}
+
+	// What's left of the lower levels goes after what the upper levels link
+	for i := 0; i < len(levels)-1; i++ {
+		if len(levels[i]) == 0 {
+			continue
+		}
+
+		lnk, err := hc.storeChunkLinks(lnkCtx, levels[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		levels[i+1] = append(levels[i+1], lnk)
+	}
+	links := levels[len(levels)-1]
+
+	root, err := fluent.BuildMap(basicnode.Prototype.Map, 1, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry(chunkedValueKey).CreateMap(2, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("size").AssignInt(size)
+			ma.AssembleEntry("chunks").CreateList(int64(len(links)), func(la fluent.ListAssembler) {
+				for _, lnk := range links {
+					la.AssembleValue().AssignLink(lnk)
+				}
+			})
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lnk, err := hc.linkSystem.Store(lnkCtx, hc.linkProto, root)
+	return lnk, size, err
+}
+
+// storeChunkLinks stores a node of the chunks tree
+func (hc *HAMTContainer) storeChunkLinks(lnkCtx ipld.LinkContext, links []ipld.Link) (ipld.Link, error) {
+	node, err := fluent.BuildList(basicnode.Prototype.List, int64(len(links)), func(la fluent.ListAssembler) {
+		for _, lnk := range links {
+			la.AssembleValue().AssignLink(lnk)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hc.linkSystem.Store(lnkCtx, hc.linkProto, node)
+}
+
+// chunkValue returns the link of the chunked data when it's above the threshold
+func (hc *HAMTContainer) chunkValue(data []byte) (ipld.Link, bool, error) {
+	if hc.chunkThreshold <= 0 || len(data) <= hc.chunkThreshold {
+		return nil, false, nil
+	}
+
+	lnk, _, err := hc.storeChunked(ipld.LinkContext{}, bytes.NewReader(data))
+	return lnk, err == nil, err
+}
+
+// openChunked returns a reader over the chunked value behind lnk
+// The boolean is false when lnk isn't the root of a chunked value
+func (hc *HAMTContainer) openChunked(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.ReadCloser, bool, error) {
+	root, err := hc.loadNode(lnkCtx, lnk)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if root.Kind() != ipld.Kind_Map {
+		return nil, false, nil
+	}
+
+	value, err := root.LookupByString(chunkedValueKey)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	sizeNode, err := value.LookupByString("size")
+	if err != nil {
+		return nil, true, ErrHAMTInvalidChunkedValue
+	}
+	size, err := sizeNode.AsInt()
+	if err != nil {
+		return nil, true, ErrHAMTInvalidChunkedValue
+	}
+
+	chunksNode, err := value.LookupByString("chunks")
+	if err != nil {
+		return nil, true, ErrHAMTInvalidChunkedValue
+	}
+
+	links, err := chunkLinks(chunksNode)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return &chunkReader{linkSystem: hc.linkSystem, lnkCtx: lnkCtx, pending: [][]ipld.Link{links}, size: size}, true, nil
+}
+
+// chunkLinks returns the links of a node of the chunks tree
+func chunkLinks(node ipld.Node) ([]ipld.Link, error) {
+	if node.Kind() != ipld.Kind_List {
+		return nil, ErrHAMTInvalidChunkedValue
+	}
+
+	links := make([]ipld.Link, 0, node.Length())
+	listIter := node.ListIterator()
+	for !listIter.Done() {
+		_, linkNode, err := listIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		lnk, err := linkNode.AsLink()
+		if err != nil {
+			return nil, ErrHAMTInvalidChunkedValue
+		}
+		links = append(links, lnk)
+	}
+
+	return links, nil
+}
+
+// chunkReader walks the chunks tree of a value as it's read, so only the
+// chunk being read is loaded along with a node per level of the tree
+type chunkReader struct {
+	linkSystem ipld.LinkSystem
+	lnkCtx     ipld.LinkContext
+	// Links left to read at each level being walked, the deepest last
+	pending [][]ipld.Link
+	size    int64
+	read    int64
+	chunk   []byte
+	closed  bool
+}
+
+// nextChunk loads the next chunk of the value, io.EOF after the last one
+func (cr *chunkReader) nextChunk() ([]byte, error) {
+	for len(cr.pending) > 0 {
+		top := len(cr.pending) - 1
+		if len(cr.pending[top]) == 0 {
+			cr.pending = cr.pending[:top]
+			continue
+		}
+
+		lnk := cr.pending[top][0]
+		cr.pending[top] = cr.pending[top][1:]
+
+		node, err := cr.linkSystem.Load(cr.lnkCtx, lnk, basicnode.Prototype.Any)
+		if err != nil {
+			return nil, err
+		}
+
+		switch node.Kind() {
+		case ipld.Kind_Bytes:
+			return node.AsBytes()
+		case ipld.Kind_List:
+			links, err := chunkLinks(node)
+			if err != nil {
+				return nil, err
+			}
+			cr.pending = append(cr.pending, links)
+		default:
+			return nil, ErrHAMTInvalidChunkedValue
+		}
+	}
+
+	return nil, io.EOF
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	for len(cr.chunk) == 0 {
+		chunk, err := cr.nextChunk()
+		if err == io.EOF {
+			if cr.read != cr.size {
+				return 0, ErrHAMTInvalidChunkedValue
+			}
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		cr.chunk = chunk
+	}
+
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	cr.read += int64(n)
+	return n, nil
+}
+
+func (cr *chunkReader) Close() error {
+	cr.closed = true
+	cr.chunk = nil
+	cr.pending = nil
+	return nil
+}
@@ -0,0 +1,373 @@
+package hamtcontainer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomBytes(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunksOf(t *testing.T, chunker Chunker, data []byte) [][]byte {
+	next := chunker(bytes.NewReader(data))
+
+	var chunks [][]byte
+	for {
+		chunk, err := next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestFixedSizeChunker(t *testing.T) {
+	assert := assert.New(t)
+
+	chunks := chunksOf(t, FixedSizeChunker(4), []byte("0123456789"))
+	assert.Equal([][]byte{[]byte("0123"), []byte("4567"), []byte("89")}, chunks)
+
+	assert.Empty(chunksOf(t, FixedSizeChunker(4), nil))
+}
+
+func TestContentDefinedChunker(t *testing.T) {
+	assert := assert.New(t)
+
+	chunker := ContentDefinedChunker(256, 1024, 4096)
+	data := randomBytes(256<<10, 1)
+
+	chunks := chunksOf(t, chunker, data)
+	assert.Equal(data, bytes.Join(chunks, nil))
+	assert.True(len(chunks) > 128 && len(chunks) < 512, "%d chunks", len(chunks))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.True(len(chunk) >= 256 && len(chunk) <= 4096)
+	}
+
+	// Inserting bytes only changes the chunks around them
+	edited := append(append(append([]byte{}, data[:100<<10]...), []byte("inserted")...), data[100<<10:]...)
+	known := make(map[string]struct{})
+	for _, chunk := range chunks {
+		known[string(chunk)] = struct{}{}
+	}
+
+	changed := 0
+	for _, chunk := range chunksOf(t, chunker, edited) {
+		if _, ok := known[string(chunk)]; !ok {
+			changed++
+		}
+	}
+	assert.True(changed <= 3, "%d chunks changed", changed)
+}
+
+func TestHAMTContainerChunkedValues(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorageWithOptions()
+	large := randomBytes(10<<10, 2)
+
+	hamtContainer, err := NewHAMTBuilder(
+		WithStorage(store),
+		WithChunking(1024, FixedSizeChunker(1000)),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+		if err := hamtSetter.Set([]byte("large"), large); err != nil {
+			return err
+		}
+		return hamtSetter.Set([]byte("small"), []byte("small"))
+	}))
+
+	// Large values are stored as a link to their chunks
+	_, err = hamtContainer.GetAsLink([]byte("large"))
+	assert.Nil(err)
+	_, err = hamtContainer.GetAsLink([]byte("small"))
+	assert.ErrorIs(err, ErrHAMTFailedToGetAsLink)
+
+	val, err := hamtContainer.GetAsBytes([]byte("large"))
+	assert.Nil(err)
+	assert.Equal(large, val)
+
+	reader, err := hamtContainer.GetReader([]byte("large"))
+	assert.Nil(err)
+	val, err = ioutil.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal(large, val)
+	assert.Nil(reader.Close())
+
+	reader, err = hamtContainer.GetReader([]byte("small"))
+	assert.Nil(err)
+	val, err = ioutil.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal([]byte("small"), val)
+
+	// Chunked values are kept by later builds, set through the container too
+	hamtContainer.Set([]byte("other"), large[:2048])
+	assert.Nil(hamtContainer.MustBuild())
+
+	lnk, err := hamtContainer.GetLink()
+	assert.Nil(err)
+
+	// And they're synced with the container
+	dst := storage.NewMemoryStorageWithOptions()
+	_, err = storage.Sync(context.Background(), lnk, store, dst)
+	assert.Nil(err)
+
+	loaded, err := NewHAMTBuilder(WithStorage(dst), WithLink(lnk)).Build()
+	assert.Nil(err)
+
+	str, err := loaded.GetAsString([]byte("large"))
+	assert.Nil(err)
+	assert.Equal(string(large), str)
+
+	val, err = loaded.GetAsBytes([]byte("other"))
+	assert.Nil(err)
+	assert.Equal(large[:2048], val)
+}
+
+func TestHAMTContainerChunksTree(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorageWithOptions()
+	hamtContainer, err := NewHAMTBuilder(WithStorage(store), WithChunking(1, FixedSizeChunker(4))).Build()
+	assert.Nil(err)
+	assert.Nil(hamtContainer.MustBuild())
+
+	// More chunks than a node of the tree links
+	data := randomBytes(4*(2*chunkLinksPerNode+10), 5)
+	blocks := store.Len()
+
+	_, lnk, err := hamtContainer.SetReader([]byte("tree"), bytes.NewReader(data))
+	assert.Nil(err)
+	assert.Nil(hamtContainer.MustBuild())
+
+	// The root links 3 nodes of chunks, the last one with the 10 chunks left
+	root, err := hamtContainer.loadNode(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	chunks, err := root.LookupByString(chunkedValueKey)
+	assert.Nil(err)
+	chunks, err = chunks.LookupByString("chunks")
+	assert.Nil(err)
+	assert.Equal(int64(3), chunks.Length())
+	assert.Equal(blocks+len(data)/4+3+1, store.Len()-1)
+
+	val, err := hamtContainer.GetAsBytes([]byte("tree"))
+	assert.Nil(err)
+	assert.Equal(data, val)
+
+	// Exactly full nodes don't leave an empty one behind
+	_, lnk, err = hamtContainer.SetReader([]byte("full"), bytes.NewReader(data[:4*chunkLinksPerNode]))
+	assert.Nil(err)
+	reader, _, err := hamtContainer.openChunked(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	val, err = ioutil.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal(data[:4*chunkLinksPerNode], val)
+}
+
+func TestHAMTContainerChunkingDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	large := randomBytes(DefaultChunkThreshold+1, 3)
+
+	// Values are kept inline unless chunking is enabled
+	inline, err := NewHAMTBuilder().Build()
+	assert.Nil(err)
+	assert.Nil(inline.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("large"), large)
+	}))
+
+	_, err = inline.GetAsLink([]byte("large"))
+	assert.ErrorIs(err, ErrHAMTFailedToGetAsLink)
+
+	parentHAMT, err := NewHAMTBuilder(WithKey([]byte("parent")), WithChunking(DefaultChunkThreshold, nil)).Build()
+	assert.Nil(err)
+
+	childHAMT, err := NewHAMTBuilder(WithKey([]byte("child")), WithStorage(parentHAMT.Storage())).Build()
+	assert.Nil(err)
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		if err := hamtSetter.Set([]byte("large"), large); err != nil {
+			return err
+		}
+		return hamtSetter.Set([]byte("child"), childHAMT)
+	}))
+
+	_, err = parentHAMT.GetAsLink([]byte("large"))
+	assert.Nil(err)
+
+	val, err := parentHAMT.GetAsBytes([]byte("large"))
+	assert.Nil(err)
+	assert.Equal(large, val)
+
+	// Links to anything else than chunks aren't bytes
+	_, err = parentHAMT.GetAsBytes([]byte("child"))
+	assert.ErrorIs(err, ErrHAMTFailedToGetAsBytes)
+	_, err = parentHAMT.GetAsString([]byte("child"))
+	assert.ErrorIs(err, ErrHAMTFailedToGetAsString)
+
+	// Links to missing blocks fail with the storage error
+	elsewhere, err := NewHAMTBuilder().Build()
+	assert.Nil(err)
+	assert.Nil(elsewhere.MustBuild())
+	missing, err := elsewhere.GetLink()
+	assert.Nil(err)
+
+	parentHAMT.Set([]byte("missing"), missing)
+	assert.Nil(parentHAMT.MustBuild())
+
+	_, err = parentHAMT.GetAsBytes([]byte("missing"))
+	assert.ErrorIs(err, storage.ErrDataNotFound)
+	_, err = parentHAMT.GetAsString([]byte("missing"))
+	assert.ErrorIs(err, storage.ErrDataNotFound)
+
+	// So do chunked values missing a chunk
+	chunk, err := parentHAMT.linkSystem.ComputeLink(parentHAMT.linkProto, basicnode.NewBytes(large[:DefaultChunkSize]))
+	assert.Nil(err)
+	assert.Nil(parentHAMT.Storage().(storage.Deleter).Delete(context.Background(), chunk))
+
+	_, err = parentHAMT.GetAsBytes([]byte("large"))
+	assert.ErrorIs(err, storage.ErrDataNotFound)
+	_, err = parentHAMT.GetAsString([]byte("large"))
+	assert.ErrorIs(err, storage.ErrDataNotFound)
+}
+
+func TestHAMTContainerSetReader(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorageWithOptions()
+	hamtContainer, err := NewHAMTBuilder(
+		WithStorage(store),
+		WithChunking(DefaultChunkThreshold, FixedSizeChunker(64<<10)),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(hamtContainer.MustBuild())
+
+	data := randomBytes(5<<20, 4)
+	blocks := store.Len()
+
+	size, lnk, err := hamtContainer.SetReader([]byte("upload"), bytes.NewReader(data))
+	assert.Nil(err)
+	assert.Equal(int64(len(data)), size)
+
+	// The chunks are stored right away, the key only once built
+	assert.Equal(blocks+80+1, store.Len())
+	_, err = hamtContainer.Get([]byte("upload"))
+	assert.ErrorIs(err, ErrHAMTValueNotFound)
+
+	assert.Nil(hamtContainer.MustBuild())
+
+	valueLink, err := hamtContainer.GetAsLink([]byte("upload"))
+	assert.Nil(err)
+	assert.Equal(lnk, valueLink)
+
+	reader, err := hamtContainer.GetReader([]byte("upload"))
+	assert.Nil(err)
+	defer reader.Close()
+
+	streamed := bytes.Buffer{}
+	_, err = io.Copy(&streamed, reader)
+	assert.Nil(err)
+	assert.Equal(data, streamed.Bytes())
+
+	// Small values are chunked too
+	size, _, err = hamtContainer.SetReader([]byte("small"), bytes.NewReader([]byte("small")))
+	assert.Nil(err)
+	assert.Equal(int64(5), size)
+	assert.Nil(hamtContainer.MustBuild())
+
+	val, err := hamtContainer.GetAsString([]byte("small"))
+	assert.Nil(err)
+	assert.Equal("small", val)
+}
+
+func TestHAMTContainerSetReaderFlushes(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := storage.NewMemoryStorageWithOptions()
+	batching := storage.NewBatchingStorage(memory)
+	hamtContainer, err := NewHAMTBuilder(
+		WithStorage(storage.NewCachedStorage(batching, 1<<20)),
+		WithChunking(0, FixedSizeChunker(1<<10)),
+	).Build()
+	assert.Nil(err)
+
+	// Buffered chunks are flushed along the way, not all held until the build
+	blocks := memory.Len()
+	_, _, err = hamtContainer.SetReader([]byte("upload"), bytes.NewReader(randomBytes(200<<10, 6)))
+	assert.Nil(err)
+	assert.Equal(3*chunkFlushInterval, memory.Len()-blocks)
+	assert.Equal(200-3*chunkFlushInterval+1, batching.Pending())
+
+	assert.Nil(hamtContainer.MustBuild())
+	assert.Equal(0, batching.Pending())
+}
+
+func TestHAMTContainerChunkedCar(t *testing.T) {
+	assert := assert.New(t)
+
+	childHAMT, err := NewHAMTBuilder(WithKey([]byte("child"))).Build()
+	assert.Nil(err)
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	data := randomBytes(10000, 4)
+	rootHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithStorage(childHAMT.Storage()),
+		WithChunking(1024, FixedSizeChunker(1000)),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		if err := hamtSetter.Set([]byte("child"), childHAMT); err != nil {
+			return err
+		}
+		return hamtSetter.Set([]byte("large"), data)
+	}))
+
+	// The car holds the chunks and the nested container, not only the root
+	path := filepath.Join(t.TempDir(), "root.car")
+	f, err := os.Create(path)
+	assert.Nil(err)
+	assert.Nil(rootHAMT.WriteCar(f))
+	assert.Nil(f.Close())
+
+	store, err := storage.NewCarStorage(path)
+	assert.Nil(err)
+	defer store.Close()
+
+	lnk, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+	assert.Nil(err)
+
+	got, err := loaded.GetAsBytes([]byte("large"))
+	assert.Nil(err)
+	assert.Equal(data, got)
+
+	child, err := NewHAMTBuilder(WithKey([]byte("child")), WithHAMTContainer(loaded)).Build()
+	assert.Nil(err)
+
+	val, err := child.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"unicode"
 
@@ -18,6 +19,17 @@ import (
 )
 
 var hostFlag string
+var storeFlag string
+
+// openStore opens the storage from --store, or the IPFS node from --host
+// Commands close it with storage.Close once done
+func openStore() (storage.Storage, error) {
+	if len(storeFlag) > 0 {
+		return storage.Open(storeFlag)
+	}
+
+	return storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag)), nil
+}
 
 var rootCmd = &cobra.Command{
 	Use: "hamtcli",
@@ -26,7 +38,7 @@ var rootCmd = &cobra.Command{
 var versionCmd = &cobra.Command{
 	Use: "version",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("hamtcli -- HAMT Container test tool")
+		fmt.Fprintln(cmd.OutOrStdout(), "hamtcli -- HAMT Container test tool")
 	},
 }
 
@@ -42,7 +54,11 @@ var setKeyCmd = &cobra.Command{
 			return fmt.Errorf("Key and values should be pairs")
 		}
 
-		store := storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag))
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
 
 		cid, err := cid.Parse(link)
 		if err != nil {
@@ -75,7 +91,66 @@ var setKeyCmd = &cobra.Command{
 			return err
 		}
 
-		fmt.Printf("HAMT %s link %s\n", string(hamt.Key()), lnk)
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s link %s\n", string(hamt.Key()), lnk)
+
+		return nil
+	},
+}
+
+var setFileCmd = &cobra.Command{
+	Use:   "set-file",
+	Short: "Streams a file, or stdin with -, as the value of a key in chunks",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		link := args[0]
+		key := args[1]
+		path := args[2]
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
+
+		cid, err := cid.Parse(link)
+		if err != nil {
+			return err
+		}
+
+		// Load HAMT from link
+		hamt, err := hamtcontainer.NewHAMTBuilder(
+			hamtcontainer.WithStorage(store),
+			hamtcontainer.WithLink(cidlink.Link{Cid: cid}),
+		).Build()
+		if err != nil {
+			return err
+		}
+
+		var reader io.Reader = cmd.InOrStdin()
+		if path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			reader = f
+		}
+
+		size, valueLink, err := hamt.SetReader([]byte(key), reader)
+		if err != nil {
+			return err
+		}
+
+		if err := hamt.MustBuild(); err != nil {
+			return err
+		}
+
+		lnk, err := hamt.GetLink()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s link %s value %s size %d\n", string(hamt.Key()), lnk, valueLink, size)
 
 		return nil
 	},
@@ -89,7 +164,11 @@ var getKeyCmd = &cobra.Command{
 		link := args[0]
 		key := args[1]
 
-		store := storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag))
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
 
 		cid, err := cid.Parse(link)
 		if err != nil {
@@ -112,13 +191,13 @@ var getKeyCmd = &cobra.Command{
 				if err != nil {
 					return err
 				}
-				fmt.Printf("HAMT %s result %s\n", string(hamt.Key()), v)
+				fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s result %s\n", string(hamt.Key()), v)
 				return nil
 			}
 			return err
 		}
 
-		fmt.Printf("HAMT %s result %s\n", string(hamt.Key()), v)
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s result %s\n", string(hamt.Key()), v)
 
 		return nil
 	},
@@ -140,7 +219,11 @@ var listKeysValues = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		link := args[0]
 
-		store := storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag))
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
 
 		cid, err := cid.Parse(link)
 		if err != nil {
@@ -158,9 +241,9 @@ var listKeysValues = &cobra.Command{
 
 		hamt.View(func(key []byte, value interface{}) error {
 			if isASCII(string(key)) {
-				fmt.Printf("key %s ", string(key))
+				fmt.Fprintf(cmd.OutOrStdout(), "key %s ", string(key))
 			} else {
-				fmt.Printf("key %s ", hex.EncodeToString(key))
+				fmt.Fprintf(cmd.OutOrStdout(), "key %s ", hex.EncodeToString(key))
 			}
 
 			nodeVal, err := utils.NodeValue(value.(ipld.Node))
@@ -170,14 +253,14 @@ var listKeysValues = &cobra.Command{
 
 			switch val := nodeVal.(type) {
 			case ipld.Link:
-				fmt.Println("link", val)
+				fmt.Fprintln(cmd.OutOrStdout(), "link", val)
 			case string:
-				fmt.Println("value", string(val))
+				fmt.Fprintln(cmd.OutOrStdout(), "value", string(val))
 			case []uint8:
 				if isASCII(string(key)) {
-					fmt.Println("value", hex.EncodeToString(val))
+					fmt.Fprintln(cmd.OutOrStdout(), "value", hex.EncodeToString(val))
 				} else {
-					fmt.Println("value", string(val))
+					fmt.Fprintln(cmd.OutOrStdout(), "value", string(val))
 				}
 			}
 
@@ -200,7 +283,11 @@ var newHAMTCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		key := args[0]
 
-		store := storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag))
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
 
 		// Create the first HAMT
 		hamt, err := hamtcontainer.NewHAMTBuilder(
@@ -220,7 +307,48 @@ var newHAMTCmd = &cobra.Command{
 			return err
 		}
 
-		fmt.Printf("HAMT %s link %s\n", string(hamt.Key()), link)
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s link %s\n", string(hamt.Key()), link)
+		return nil
+	},
+}
+
+var migrateHAMTCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Rewrites a hex keyed HAMT with raw keys and return the new link",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		link := args[0]
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
+
+		cid, err := cid.Parse(link)
+		if err != nil {
+			return err
+		}
+
+		// Load HAMT from link
+		hamt, err := hamtcontainer.NewHAMTBuilder(
+			hamtcontainer.WithStorage(store),
+			hamtcontainer.WithLink(cidlink.Link{Cid: cid}),
+		).Build()
+		if err != nil {
+			return err
+		}
+
+		if err := hamt.MigrateKeyFormat(hamtcontainer.KeyFormatRaw); err != nil {
+			return err
+		}
+
+		lnk, err := hamt.GetLink()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s link %s\n", string(hamt.Key()), lnk)
 		return nil
 	},
 }
@@ -233,7 +361,11 @@ var setHAMTLinkCmd = &cobra.Command{
 		link := args[0]
 		childLink := args[1]
 
-		store := storage.NewIPFSStorage(ipfsApi.NewShell(hostFlag))
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer storage.Close(store)
 
 		parentCid, err := cid.Parse(link)
 		if err != nil {
@@ -278,7 +410,7 @@ var setHAMTLinkCmd = &cobra.Command{
 			return err
 		}
 
-		fmt.Printf("HAMT %s link %s\n", string(parentHamt.Key()), parentHamtLink)
+		fmt.Fprintf(cmd.OutOrStdout(), "HAMT %s link %s\n", string(parentHamt.Key()), parentHamtLink)
 		return nil
 	},
 }
@@ -286,17 +418,20 @@ var setHAMTLinkCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(setKeyCmd)
+	rootCmd.AddCommand(setFileCmd)
 	rootCmd.AddCommand(getKeyCmd)
 	rootCmd.AddCommand(hamtCmd)
 	rootCmd.AddCommand(listKeysValues)
 
 	hamtCmd.AddCommand(setHAMTLinkCmd)
 	hamtCmd.AddCommand(newHAMTCmd)
-}
+	hamtCmd.AddCommand(migrateHAMTCmd)
 
-func main() {
 	rootCmd.PersistentFlags().StringVarP(&hostFlag, "host", "H", "", "host of the IPFS node")
+	rootCmd.PersistentFlags().StringVarP(&storeFlag, "store", "S", "", "storage URL, e.g. redis://localhost:6379?cache=64MB, overrides --host")
+}
 
+func main() {
 	if len(hostFlag) == 0 {
 		tmpHostFlag, ok := os.LookupEnv("IPFS_URL")
 		if !ok {
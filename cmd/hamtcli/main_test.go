@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/ipfstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func runCLI(t *testing.T, args ...string) string {
+	t.Helper()
+
+	// Flags are globals, don't leak them across runs
+	hostFlag, storeFlag = "", ""
+
+	out := bytes.Buffer{}
+	rootCmd.SetOut(&out)
+	rootCmd.SetArgs(args)
+	assert.Nil(t, rootCmd.Execute())
+
+	return out.String()
+}
+
+// linkOf picks the link out of a "HAMT <key> link <cid>" line
+func linkOf(t *testing.T, out string) string {
+	t.Helper()
+
+	fields := strings.Fields(out)
+	if !assert.Len(t, fields, 4) {
+		t.FailNow()
+	}
+	return fields[3]
+}
+
+func TestCLI(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+
+	root := linkOf(t, runCLI(t, "--host", server.URL, "hamt", "new", "root"))
+	root = linkOf(t, runCLI(t, "--host", server.URL, "set", root, "foo", "bar", "zoo", "zar"))
+
+	assert.Equal("HAMT root result bar\n", runCLI(t, "--host", server.URL, "get", root, "foo"))
+
+	child := linkOf(t, runCLI(t, "--host", server.URL, "hamt", "new", "child"))
+	root = linkOf(t, runCLI(t, "--host", server.URL, "hamt", "link", root, child))
+
+	assert.Equal("HAMT root result "+child+"\n", runCLI(t, "--host", server.URL, "get", root, "child"))
+
+	// Byte values of printable keys are listed hex encoded
+	list := runCLI(t, "--host", server.URL, "list", root)
+	assert.Contains(list, "key foo value 626172\n")
+	assert.Contains(list, "key zoo value 7a6172\n")
+	assert.Contains(list, "key child link "+child+"\n")
+}
+
+func TestCLIWithStore(t *testing.T) {
+	assert := assert.New(t)
+
+	server, err := miniredis.Run()
+	assert.Nil(err)
+	defer server.Close()
+
+	store := "redis://" + server.Addr() + "?prefix=cli:&cache=1MB"
+
+	root := linkOf(t, runCLI(t, "--store", store, "hamt", "new", "root"))
+	root = linkOf(t, runCLI(t, "--store", store, "set", root, "foo", "bar"))
+
+	assert.Equal("HAMT root result bar\n", runCLI(t, "--store", store, "get", root, "foo"))
+	assert.True(server.Exists("cli:" + root))
+
+	// Migrated containers keep their values under a new link
+	migrated := linkOf(t, runCLI(t, "--store", store, "hamt", "migrate", root))
+	assert.NotEqual(root, migrated)
+	assert.Equal("HAMT root result bar\n", runCLI(t, "--store", store, "get", migrated, "foo"))
+}
+
+func TestCLISetFile(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "value.txt")
+	content := strings.Repeat("streamed ", 100000)
+	assert.Nil(ioutil.WriteFile(path, []byte(content), 0644))
+
+	root := linkOf(t, runCLI(t, "--host", server.URL, "hamt", "new", "root"))
+
+	fields := strings.Fields(runCLI(t, "--host", server.URL, "set-file", root, "file", path))
+	if !assert.Len(fields, 8) {
+		t.FailNow()
+	}
+	assert.Equal(fmt.Sprint(len(content)), fields[7])
+	root = fields[3]
+
+	assert.Equal("HAMT root result "+content+"\n", runCLI(t, "--host", server.URL, "get", root, "file"))
+}
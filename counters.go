@@ -0,0 +1,125 @@
+package hamtcontainer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// OperationCounters are the totals kept by Counters for an operation
+type OperationCounters struct {
+	Calls           uint64
+	Errors          uint64
+	DurationSeconds float64
+	Blocks          int64
+	Bytes           int64
+}
+
+// Counters is an Observer keeping Prometheus-style counters per operation.
+// It serves them in the Prometheus text format, so it can be scraped as is:
+//
+//	counters := hamtcontainer.NewCounters("hamt")
+//	http.Handle("/metrics", counters)
+//	hamtcontainer.NewHAMTBuilder(hamtcontainer.WithObserver(counters)).Build()
+type Counters struct {
+	namespace string
+
+	mutex      sync.Mutex
+	operations map[Operation]*OperationCounters
+}
+
+// NewCounters creates Counters whose metric names are prefixed by namespace
+func NewCounters(namespace string) *Counters {
+	return &Counters{
+		namespace:  namespace,
+		operations: make(map[Operation]*OperationCounters),
+	}
+}
+
+// Observe adds the event to the counters of its operation
+func (c *Counters) Observe(event Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counters, exists := c.operations[event.Op]
+	if !exists {
+		counters = &OperationCounters{}
+		c.operations[event.Op] = counters
+	}
+
+	counters.Calls++
+	if event.Err != nil {
+		counters.Errors++
+	}
+	counters.DurationSeconds += event.Duration.Seconds()
+	counters.Blocks += event.Blocks
+	counters.Bytes += event.Bytes
+}
+
+// Snapshot returns a copy of the counters of every operation observed
+func (c *Counters) Snapshot() map[Operation]OperationCounters {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	snapshot := make(map[Operation]OperationCounters, len(c.operations))
+	for op, counters := range c.operations {
+		snapshot[op] = *counters
+	}
+	return snapshot
+}
+
+// WritePrometheus writes the counters in the Prometheus text exposition format
+func (c *Counters) WritePrometheus(w io.Writer) error {
+	snapshot := c.Snapshot()
+
+	ops := make([]string, 0, len(snapshot))
+	for op := range snapshot {
+		ops = append(ops, string(op))
+	}
+	sort.Strings(ops)
+
+	metrics := []struct {
+		name  string
+		help  string
+		value func(OperationCounters) string
+	}{
+		{"operations_total", "Operations performed.", func(oc OperationCounters) string {
+			return fmt.Sprint(oc.Calls)
+		}},
+		{"operation_errors_total", "Operations failed.", func(oc OperationCounters) string {
+			return fmt.Sprint(oc.Errors)
+		}},
+		{"operation_duration_seconds_total", "Time spent in operations.", func(oc OperationCounters) string {
+			return fmt.Sprint(oc.DurationSeconds)
+		}},
+		{"storage_blocks_total", "Blocks read or written by operations.", func(oc OperationCounters) string {
+			return fmt.Sprint(oc.Blocks)
+		}},
+		{"storage_bytes_total", "Bytes read or written by operations.", func(oc OperationCounters) string {
+			return fmt.Sprint(oc.Bytes)
+		}},
+	}
+
+	for _, metric := range metrics {
+		name := c.namespace + "_" + metric.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, metric.help, name); err != nil {
+			return err
+		}
+
+		for _, op := range ops {
+			if _, err := fmt.Fprintf(w, "%s{op=%q} %s\n", name, op, metric.value(snapshot[Operation(op)])); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP serves the counters to Prometheus scrapes
+func (c *Counters) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = c.WritePrometheus(w)
+}
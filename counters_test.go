@@ -0,0 +1,51 @@
+package hamtcontainer
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounters(t *testing.T) {
+	assert := assert.New(t)
+
+	counters := NewCounters("hamt")
+	counters.Observe(Event{Op: OpGet, Duration: time.Second})
+	counters.Observe(Event{Op: OpGet, Duration: time.Second, Err: errors.New("failed")})
+	counters.Observe(Event{Op: OpStorageRead, Duration: time.Millisecond, Blocks: 1, Bytes: 100})
+
+	snapshot := counters.Snapshot()
+	assert.Equal(OperationCounters{Calls: 2, Errors: 1, DurationSeconds: 2}, snapshot[OpGet])
+	assert.Equal(OperationCounters{Calls: 1, DurationSeconds: 0.001, Blocks: 1, Bytes: 100}, snapshot[OpStorageRead])
+
+	out := bytes.Buffer{}
+	assert.Nil(counters.WritePrometheus(&out))
+	assert.Contains(out.String(), "# TYPE hamt_operations_total counter\n")
+	assert.Contains(out.String(), "hamt_operations_total{op=\"get\"} 2\n")
+	assert.Contains(out.String(), "hamt_operation_errors_total{op=\"get\"} 1\n")
+	assert.Contains(out.String(), "hamt_storage_bytes_total{op=\"storage_read\"} 100\n")
+
+	recorder := httptest.NewRecorder()
+	counters.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(out.String(), recorder.Body.String())
+}
+
+func TestCountersObserveContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	counters := NewCounters("hamt")
+	hamtContainer, err := NewHAMTBuilder(WithObserver(counters)).Build()
+	assert.Nil(err)
+
+	assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	snapshot := counters.Snapshot()
+	assert.Equal(uint64(1), snapshot[OpMustBuild].Calls)
+	assert.Equal(snapshot[OpStorageWrite].Bytes, snapshot[OpMustBuild].Bytes)
+}
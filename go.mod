@@ -3,14 +3,18 @@ module github.com/simplecoincom/go-ipld-adl-hamt-container
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/go-redis/redis/v8 v8.11.1
 	github.com/ipfs/go-block-format v0.0.3
 	github.com/ipfs/go-cid v0.0.7
 	github.com/ipfs/go-ipfs-api v0.2.0
+	github.com/ipfs/go-ipfs-files v0.0.8
 	github.com/ipld/go-car v0.3.1
 	github.com/ipld/go-ipld-adl-hamt v0.0.0-20210722170621-f1bab170b777
 	github.com/ipld/go-ipld-prime v0.10.0
+	github.com/klauspost/compress v1.13.6
 	github.com/multiformats/go-multicodec v0.2.0
+	github.com/multiformats/go-multihash v0.0.15
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.2.1
 	github.com/stretchr/testify v1.7.0
@@ -1,6 +1,8 @@
 package hamtcontainer
 
 import (
+	"time"
+
 	"github.com/pkg/errors"
 
 	"github.com/ipfs/go-cid"
@@ -20,6 +22,14 @@ type HAMTBuilder struct {
 	storage             storage.Storage
 	link                ipld.Link
 	parentHAMTContainer *HAMTContainer
+	nodeCache           NodeCache
+	verifyBlocks        bool
+	observer            Observer
+	chunkThreshold      int
+	chunker             Chunker
+	keyFormat           KeyFormat
+	labels              map[string]string
+	createdAt           time.Time
 }
 
 // NewHAMTBuilder create a new HAMTBuilder helper
@@ -59,6 +69,67 @@ func WithHAMTContainer(hamtContainer *HAMTContainer) Option {
 	}
 }
 
+// WithNodeCache sets the cache of decoded nodes shared with other HAMTContainers
+// Use DefaultNodeCache to share it process-wide
+func WithNodeCache(nodeCache NodeCache) Option {
+	return func(h *HAMTBuilder) {
+		h.nodeCache = nodeCache
+	}
+}
+
+// WithBlockVerification checks every block read from the storage against its link
+// Blocks not matching fail with storage.ErrBlockCorrupted
+func WithBlockVerification() Option {
+	return func(h *HAMTBuilder) {
+		h.verifyBlocks = true
+	}
+}
+
+// WithObserver reports the container operations, and the storage reads and writes they cause
+func WithObserver(observer Observer) Option {
+	return func(h *HAMTBuilder) {
+		h.observer = observer
+	}
+}
+
+// WithChunking splits byte values above threshold bytes into chunks linked from
+// the container, instead of storing them inline. The chunker defaults to
+// FixedSizeChunker(DefaultChunkSize) and a threshold of 0, the default,
+// disables chunking. SetReader always chunks, with the given chunker.
+func WithChunking(threshold int, chunker Chunker) Option {
+	return func(h *HAMTBuilder) {
+		if chunker == nil {
+			chunker = FixedSizeChunker(DefaultChunkSize)
+		}
+		h.chunkThreshold = threshold
+		h.chunker = chunker
+	}
+}
+
+// WithKeyFormat sets how the keys of the future HAMTContainer are written
+// Containers loaded from a link or a parent keep the format they were built with
+func WithKeyFormat(format KeyFormat) Option {
+	return func(h *HAMTBuilder) {
+		h.keyFormat = format
+	}
+}
+
+// WithLabels sets the user-defined labels kept in the metadata of the future HAMTContainer
+// Containers loaded from a link or a parent keep the labels they were built with
+func WithLabels(labels map[string]string) Option {
+	return func(h *HAMTBuilder) {
+		h.labels = labels
+	}
+}
+
+// WithCreatedAt records the creation time in the metadata of the future HAMTContainer
+// Without it the time isn't recorded, so the same entries always get the same link
+func WithCreatedAt(createdAt time.Time) Option {
+	return func(h *HAMTBuilder) {
+		h.createdAt = createdAt.UTC()
+	}
+}
+
 func (hb *HAMTBuilder) parseParamRules() error {
 	// Should parse params and helps with some rules
 
@@ -86,6 +157,33 @@ func (hb *HAMTBuilder) parseParamRules() error {
 	// If parent isn't nil then we should use it storage
 	if hb.parentHAMTContainer != nil {
 		hb.storage = hb.parentHAMTContainer.Storage()
+
+		// Nested containers share the parent node cache unless told otherwise
+		if hb.nodeCache == nil {
+			hb.nodeCache = hb.parentHAMTContainer.nodeCache
+		}
+
+		// And its observer
+		if hb.observer == nil {
+			hb.observer = hb.parentHAMTContainer.observer
+		}
+
+		// And its chunking
+		if hb.chunker == nil {
+			hb.chunkThreshold = hb.parentHAMTContainer.chunkThreshold
+			hb.chunker = hb.parentHAMTContainer.chunker
+		}
+	}
+
+	// Values stay inline unless told otherwise, only SetReader chunks them
+	if hb.chunker == nil {
+		hb.chunkThreshold = 0
+		hb.chunker = FixedSizeChunker(DefaultChunkSize)
+	}
+
+	// The parent storage may already be verifying
+	if _, ok := hb.storage.(*storage.Verifying); hb.verifyBlocks && !ok {
+		hb.storage = storage.NewVerifyingStorage(hb.storage)
 	}
 
 	return nil
@@ -98,9 +196,16 @@ func (hb HAMTBuilder) Build() (*HAMTContainer, error) {
 	}
 
 	newHAMTContainer := &HAMTContainer{
-		key:     hb.key,
-		kvCache: make(map[string]interface{}),
-		storage: hb.storage,
+		key:       hb.key,
+		kvCache:   make(map[string]interface{}),
+		storage:   hb.storage,
+		nodeCache: hb.nodeCache,
+		observer:  hb.observer,
+
+		chunkThreshold: hb.chunkThreshold,
+		chunker:        hb.chunker,
+		keyFormat:      hb.keyFormat,
+		metadata:       Metadata{CreatedAt: hb.createdAt, Labels: copyLabels(hb.labels)},
 	}
 
 	// Sets the link system
@@ -116,6 +221,15 @@ func (hb HAMTBuilder) Build() (*HAMTContainer, error) {
 	newHAMTContainer.linkSystem.StorageWriteOpener = newHAMTContainer.storage.OpenWrite
 	newHAMTContainer.linkSystem.StorageReadOpener = newHAMTContainer.storage.OpenRead
 
+	if newHAMTContainer.observer != nil {
+		newHAMTContainer.observeLinkSystem()
+	}
+
+	// No need to hash blocks twice, the storage already does it
+	if _, ok := newHAMTContainer.storage.(*storage.Verifying); ok {
+		newHAMTContainer.linkSystem.TrustedStorage = true
+	}
+
 	// If has a parent we should load from it
 	if hb.parentHAMTContainer != nil {
 
@@ -138,14 +252,5 @@ func (hb HAMTBuilder) Build() (*HAMTContainer, error) {
 		}
 	}
 
-	// If has the parent container and the link we should load the key from it
-	if hb.parentHAMTContainer != nil || hb.link != nil {
-		key, err := newHAMTContainer.GetAsBytes([]byte(reservedNameKey))
-		if err != nil {
-			return nil, err
-		}
-		newHAMTContainer.key = key
-	}
-
 	return newHAMTContainer, nil
 }
@@ -1,6 +1,7 @@
 package hamtcontainer
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
@@ -67,3 +68,35 @@ func TestBuilderWithParentParam(t *testing.T) {
 	assert.Nil(err)
 	assert.NotNil(newContainer)
 }
+
+func TestBuilderWithBlockVerification(t *testing.T) {
+	assert := assert.New(t)
+	store := storage.NewMemoryStorage()
+
+	hamtContainer, err := NewHAMTBuilder(
+		WithStorage(store),
+		WithBlockVerification(),
+	).Build()
+	assert.Nil(err)
+	assert.IsType(&storage.Verifying{}, hamtContainer.Storage())
+
+	assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	lnk, err := hamtContainer.GetLink()
+	assert.Nil(err)
+
+	// Corrupt the root block
+	memory := store.(*storage.Memory)
+	data := append([]byte{}, memory.Bag[lnk]...)
+	data[len(data)-1] ^= 0xff
+	memory.Bag[lnk] = data
+
+	_, err = NewHAMTBuilder(
+		WithStorage(store),
+		WithLink(lnk),
+		WithBlockVerification(),
+	).Build()
+	assert.True(errors.As(err, &storage.ErrBlockCorrupted{}))
+}
@@ -1,20 +1,18 @@
 package hamtcontainer
 
 import (
+	"bytes"
 	"context"
-	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
 	"sync"
 
 	"github.com/ipfs/go-cid"
-	gocar "github.com/ipld/go-car"
 	hamt "github.com/ipld/go-ipld-adl-hamt"
 	ipld "github.com/ipld/go-ipld-prime"
 	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
-	"github.com/ipld/go-ipld-prime/traversal/selector"
-	sbuilder "github.com/ipld/go-ipld-prime/traversal/selector/builder"
 	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
 	"github.com/simplecoincom/go-ipld-adl-hamt-container/utils"
 )
@@ -49,12 +47,24 @@ type HAMTContainer struct {
 	linkSystem ipld.LinkSystem
 	linkProto  ipld.LinkPrototype
 	node       ipld.Node
+	nodeCache  NodeCache
+	observer   Observer
+	traffic    storageTraffic
 	limit      int
+	// Byte values above the threshold are split by the chunker
+	chunkThreshold int
+	chunker        Chunker
+	keyFormat      KeyFormat
+	// Name and key format aside, they're in key and keyFormat
+	metadata Metadata
+	// Loaded from a root holding its metadata among the entries
+	legacy bool
 }
 
 // HAMTSetter is a helper structure for set HAMT key values
 type HAMTSetter struct {
 	assembler ipld.MapAssembler
+	hc        *HAMTContainer
 }
 
 // Key returns the key that identifies the HAMT
@@ -99,33 +109,70 @@ func (hc *HAMTContainer) GetLink() (ipld.Link, error) {
 
 // LoadLink will load the storage data from a new HAMTContainer
 // Or it illl return and error if the load failed
-func (hc *HAMTContainer) LoadLink(link ipld.Link) error {
+func (hc *HAMTContainer) LoadLink(link ipld.Link) (err error) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
+	defer hc.observe(OpLoadLink, &err)()
 
-	nodePrototype := basicnode.Prototype.Any
+	node, err := hc.loadNode(ipld.LinkContext{}, link)
+	if err != nil {
+		return err
+	}
 
-	node, err := hc.linkSystem.Load(
-		ipld.LinkContext{}, // The zero value is fine.  Configure it it you want cancellability or other features.
-		link,               // The Link we want to load!
-		nodePrototype,      // The NodePrototype says what kind of Node we want as a result.
-	)
+	entries, metadata, legacy, err := readRoot(node)
 	if err != nil {
 		return err
 	}
 
 	hc.link = link
-	hc.node = node
+	hc.node = entries
+	hc.key = metadata.Name
+	hc.keyFormat = metadata.KeyFormat
+	hc.metadata = metadata
+	hc.legacy = legacy
 
 	return nil
 }
 
+// loadNode loads and decodes the node behind the link
+// When a NodeCache is set it skips both fetching and decoding of known links
+func (hc *HAMTContainer) loadNode(lnkCtx ipld.LinkContext, link ipld.Link) (ipld.Node, error) {
+	if hc.nodeCache != nil {
+		if node, ok := hc.nodeCache.Get(link); ok {
+			return node, nil
+		}
+	}
+
+	nodePrototype := basicnode.Prototype.Any
+
+	node, err := hc.linkSystem.Load(
+		lnkCtx,        // Carries the key reported to the observer, when loading without the mutex
+		link,          // The Link we want to load!
+		nodePrototype, // The NodePrototype says what kind of Node we want as a result.
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if hc.nodeCache != nil {
+		hc.nodeCache.Add(link, node)
+	}
+
+	return node, nil
+}
+
 // MustBuild is used to build the key maps
 // It'll generate the final version of the node with the link
-func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
+func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) (err error) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
+	defer hc.observe(OpMustBuild, &err)()
 
+	return hc.build(assemblyFuncs...)
+}
+
+// build must be called with the mutex held
+func (hc *HAMTContainer) build(assemblyFuncs ...AssemblerFunc) error {
 	// Creates the builder for the HAMT
 	builder := hamt.NewBuilder(hamt.Prototype{BitWidth: BitWidth, BucketSize: BucketSize}).
 		WithLinking(hc.linkSystem, hc.linkProto)
@@ -136,17 +183,6 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 		return err
 	}
 
-	// Set key and value for reserved name
-	{
-		if err := assembler.AssembleKey().AssignString(hex.EncodeToString([]byte(reservedNameKey))); err != nil {
-			return err
-		}
-
-		if err := assembler.AssembleValue().AssignBytes(hc.key); err != nil {
-			return err
-		}
-	}
-
 	// Node not nil, then should concat
 	if hc.node != nil {
 		mapIter := hc.node.MapIterator()
@@ -164,13 +200,13 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 			}
 
 			// But should be decoded to bytes
-			kb, err := hex.DecodeString(ks)
+			kb, err := hc.keyFormat.decode(ks)
 			if err != nil {
 				return err
 			}
 
 			// Do not view meta keys
-			if string(kb) == reservedNameKey {
+			if hc.isMetaKey(kb) {
 				continue
 			}
 
@@ -206,13 +242,13 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 				return err
 			}
 
-			bs, err := hex.DecodeString(ks)
+			bs, err := hc.keyFormat.decode(ks)
 			if err != nil {
 				return err
 			}
 
 			// Do not view meta keys
-			if string(bs) == reservedNameKey {
+			if hc.isMetaKey(bs) {
 				continue
 			}
 
@@ -232,6 +268,18 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 		}
 	}
 
+	// Set can't fail, so keys the format can't write are dropped when built
+	var invalidKey error
+	for k := range hc.kvCache {
+		if err := hc.keyFormat.check([]byte(k)); err != nil {
+			delete(hc.kvCache, k)
+			invalidKey = err
+		}
+	}
+	if invalidKey != nil {
+		return invalidKey
+	}
+
 	for k, v := range hc.kvCache {
 		if err := assembler.AssembleKey().AssignString(k); err != nil {
 			return err
@@ -244,6 +292,15 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 				return err
 			}
 		case []byte:
+			if link, chunked, err := hc.chunkValue(v); err != nil {
+				return err
+			} else if chunked {
+				if err := assembler.AssembleValue().AssignLink(link); err != nil {
+					return err
+				}
+				continue
+			}
+
 			if err := assembler.AssembleValue().AssignBytes(v); err != nil {
 				return err
 			}
@@ -276,7 +333,7 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 
 	// Run the assembly funcs
 	for _, assemblyFunc := range assemblyFuncs {
-		if err := assemblyFunc(HAMTSetter{assembler}); err != nil {
+		if err := assemblyFunc(HAMTSetter{assembler: assembler, hc: hc}); err != nil {
 			return err
 		}
 	}
@@ -289,35 +346,87 @@ func (hc *HAMTContainer) MustBuild(assemblyFuncs ...AssemblerFunc) error {
 	// Build the hamt
 	hc.node = hamt.Build(builder)
 
+	metadata := hc.metadata
+	metadata.Name = hc.key
+	metadata.Version = FormatVersion
+	metadata.BitWidth = BitWidth
+	metadata.BucketSize = BucketSize
+	metadata.KeyFormat = hc.keyFormat
+
+	// The root wraps the entries with the metadata, older roots are upgraded
+	root, err := rootNode(metadata, hc.node)
+	if err != nil {
+		return err
+	}
+
 	// Store the values into link system
 	link, err := hc.linkSystem.Store(
 		ipld.LinkContext{},
 		hc.linkProto,
-		hc.node,
+		root,
 	)
 
 	if err != nil {
 		return err
 	}
 
+	// Buffered storages should write the whole build at once
+	if err := storage.Flush(context.Background(), hc.storage); err != nil {
+		return err
+	}
+
+	// Keep the new root alive, it supersedes the current one
+	if pinner, ok := hc.storage.(storage.RootPinner); ok {
+		if err := pinner.PinRoot(context.Background(), link, hc.link); err != nil {
+			return err
+		}
+	}
+
 	// Our current link
 	hc.link = link
+	hc.metadata = metadata
+	hc.legacy = false
 
 	return nil
 }
 
 // Set adds k/v to the hamt but not imediately and only when build
+// With KeyFormatRaw, keys which aren't valid UTF-8 fail the next build with
+// ErrHAMTInvalidRawKey and are dropped
 func (hc *HAMTContainer) Set(key []byte, value interface{}) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
-	hc.kvCache[hex.EncodeToString(key)] = value
+	hc.kvCache[hc.keyFormat.encode(key)] = value
+}
+
+// SetReader streams the data read from r into chunks, whatever its size, and
+// returns the size and the link of the chunked value. Chunks are stored as
+// they're read, but like Set the key is only added when build.
+//
+// Memory stays bounded only when the storage doesn't keep the chunks in
+// memory itself. Buffering storages, like Batching, are flushed every
+// chunkFlushInterval chunks, but the Memory storage holds them all.
+func (hc *HAMTContainer) SetReader(key []byte, r io.Reader) (int64, ipld.Link, error) {
+	// Storing the chunks doesn't need the container state, other calls aren't held up
+	link, size, err := hc.storeChunked(withObservedKey(hc.Key()), r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hc.Set(key, link)
+
+	return size, link, nil
 }
 
 // Set adds a new k/v content for the HAMT
 // For string values it will add k/v pair of strings
 // For ipld.Link values it will add string key and a link for another HAMT structure as value
 func (hs *HAMTSetter) Set(key []byte, value interface{}) error {
-	if err := hs.assembler.AssembleKey().AssignString(hex.EncodeToString(key)); err != nil {
+	if err := hs.hc.keyFormat.check(key); err != nil {
+		return err
+	}
+
+	if err := hs.assembler.AssembleKey().AssignString(hs.hc.keyFormat.encode(key)); err != nil {
 		return err
 	}
 
@@ -328,6 +437,12 @@ func (hs *HAMTSetter) Set(key []byte, value interface{}) error {
 			return err
 		}
 	case []byte:
+		if link, chunked, err := hs.hc.chunkValue(v); err != nil {
+			return err
+		} else if chunked {
+			return hs.assembler.AssembleValue().AssignLink(link)
+		}
+
 		if err := hs.assembler.AssembleValue().AssignBytes(v); err != nil {
 			return err
 		}
@@ -362,9 +477,10 @@ func (hs *HAMTSetter) Set(key []byte, value interface{}) error {
 
 // Get will return the value by the key
 // It will return error if the hamt not build or if the value not found
-func (hc *HAMTContainer) Get(key []byte) (interface{}, error) {
+func (hc *HAMTContainer) Get(key []byte) (value interface{}, err error) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
+	defer hc.observe(OpGet, &err)()
 
 	// Node should be build to retrieve values
 	if hc.node == nil {
@@ -372,7 +488,7 @@ func (hc *HAMTContainer) Get(key []byte) (interface{}, error) {
 	}
 
 	// Lookup by string, first translate the byte to hex string
-	valNode, err := hc.node.LookupByString(hex.EncodeToString(key))
+	valNode, err := hc.node.LookupByString(hc.keyFormat.encode(key))
 	if err != nil {
 		if errors.Is(err, err.(ipld.ErrNotExists)) {
 			return nil, ErrHAMTValueNotFound
@@ -404,21 +520,62 @@ func (hc *HAMTContainer) GetAsLink(key []byte) (ipld.Link, error) {
 }
 
 // GetAsBytes returns a byte slice type by key
+// Chunked values are reassembled from their chunks
 // The method will fail if the returned type isn't of type byte slice
 func (hc *HAMTContainer) GetAsBytes(key []byte) ([]byte, error) {
+	reader, err := hc.GetReader(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if r, ok := reader.(*bytesReadCloser); ok {
+		return r.data, nil
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// GetReader returns a reader over the byte slice value of the key
+// Chunked values are streamed, their chunks being loaded as they're read
+// The method will fail if the returned type isn't of type byte slice,
+// or with the storage error, like storage.ErrDataNotFound, when blocks are missing
+func (hc *HAMTContainer) GetReader(key []byte) (io.ReadCloser, error) {
 	result, err := hc.Get(key)
 	if err != nil {
 		return nil, err
 	}
 
-	switch result.(type) {
+	switch r := result.(type) {
 	case []byte:
-		return result.([]byte), nil
+		return &bytesReadCloser{Reader: bytes.NewReader(r), data: r}, nil
+	case ipld.Link:
+		// Storage errors, like a missing block, are returned as they are
+		reader, chunked, err := hc.openChunked(withObservedKey(hc.Key()), r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !chunked {
+			return nil, ErrHAMTFailedToGetAsBytes
+		}
+
+		return reader, nil
 	default:
 		return nil, ErrHAMTFailedToGetAsBytes
 	}
 }
 
+// bytesReadCloser keeps the inline value, GetAsBytes doesn't need to copy it
+type bytesReadCloser struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
+
 // GetAsString returns a string type by key
 // The method will fail if the returned type isn't of type string or failed to convert to string
 func (hc *HAMTContainer) GetAsString(key []byte) (string, error) {
@@ -432,15 +589,23 @@ func (hc *HAMTContainer) GetAsString(key []byte) (string, error) {
 		return string(r), nil
 	case string:
 		return r, nil
+	case ipld.Link:
+		// Maybe a chunked value
+		data, err := hc.GetAsBytes(key)
+		if errors.Is(err, ErrHAMTFailedToGetAsBytes) {
+			return "", ErrHAMTFailedToGetAsString
+		}
+		return string(data), err
 	default:
 		return "", ErrHAMTFailedToGetAsString
 	}
 }
 
 // View will iterate over each item key map
-func (hc *HAMTContainer) View(iterFunc func(key []byte, value interface{}) error) error {
+func (hc *HAMTContainer) View(iterFunc func(key []byte, value interface{}) error) (err error) {
 	hc.mutex.RLock()
 	defer hc.mutex.RUnlock()
+	defer hc.observe(OpView, &err)()
 
 	// Should build the node before
 	if hc.node == nil {
@@ -462,13 +627,13 @@ func (hc *HAMTContainer) View(iterFunc func(key []byte, value interface{}) error
 		}
 
 		// Decode to bytes before return
-		kb, err := hex.DecodeString(ks)
+		kb, err := hc.keyFormat.decode(ks)
 		if err != nil {
 			return err
 		}
 
 		// Do not expose meta keys
-		if string(kb) == reservedNameKey {
+		if hc.isMetaKey(kb) {
 			continue
 		}
 
@@ -481,8 +646,12 @@ func (hc *HAMTContainer) View(iterFunc func(key []byte, value interface{}) error
 	return nil
 }
 
-// WriteCar creates the car file
-func (hc *HAMTContainer) WriteCar(writer io.Writer) error {
+// Prefetch loads every block linked by the container values ahead of their reads
+// so nested containers can be followed without a round trip each
+// View doesn't follow the values, so it's up to the caller to prefetch before,
+// while WriteCar and WriteDeltaCar prefetch as they walk the container
+// It does nothing unless the storage is a storage.Prefetcher, like storage.Cached
+func (hc *HAMTContainer) Prefetch(ctx context.Context) error {
 	hc.mutex.RLock()
 	defer hc.mutex.RUnlock()
 
@@ -490,30 +659,85 @@ func (hc *HAMTContainer) WriteCar(writer io.Writer) error {
 		return ErrHAMTNotBuild
 	}
 
-	lnk, err := hc.GetLink()
-	if err != nil {
-		return err
+	prefetcher, ok := hc.storage.(storage.Prefetcher)
+	if !ok {
+		return nil
 	}
 
-	cid, err := cid.Parse(lnk.String())
-	if err != nil {
-		return err
-	}
+	var links []ipld.Link
+	mapIter := hc.node.MapIterator()
 
-	ssb := sbuilder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
-	selector := ssb.ExploreFields(func(efsb sbuilder.ExploreFieldsSpecBuilder) {
-		efsb.Insert("Links",
-			ssb.ExploreIndex(1, ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))))
-	}).Node()
+	for !mapIter.Done() {
+		_, value, err := mapIter.Next()
+		if err != nil {
+			return err
+		}
 
-	lsysStore := utils.ToReadStore(hc.linkSystem.StorageReadOpener)
-	sc := gocar.NewSelectiveCar(context.Background(), lsysStore, []gocar.Dag{{Root: cid, Selector: selector}})
+		if value.Kind() != ipld.Kind_Link {
+			continue
+		}
 
-	blockCount := 0
-	var oneStepBlocks []gocar.Block
-	return sc.Write(writer, func(block gocar.Block) error {
-		oneStepBlocks = append(oneStepBlocks, block)
-		blockCount++
+		link, err := value.AsLink()
+		if err != nil {
+			return err
+		}
+
+		links = append(links, link)
+	}
+
+	if len(links) == 0 {
 		return nil
-	})
+	}
+
+	return prefetcher.Prefetch(ctx, links)
+}
+
+// WriteCar creates the car file holding every block of the container,
+// nested containers and chunked values included
+func (hc *HAMTContainer) WriteCar(writer io.Writer) (err error) {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	defer hc.observe(OpWriteCar, &err)()
+
+	if hc.node == nil {
+		return ErrHAMTNotBuild
+	}
+
+	return storage.WriteDeltaCar(context.Background(), writer, linkSystemStorage{hc}, nil, hc.link)
+}
+
+// WriteDeltaCar creates a car file holding only the blocks of the container
+// which aren't reachable from oldRoot, see storage.WriteDeltaCar
+func (hc *HAMTContainer) WriteDeltaCar(writer io.Writer, oldRoot ipld.Link) (err error) {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	defer hc.observe(OpWriteDeltaCar, &err)()
+
+	if hc.node == nil {
+		return ErrHAMTNotBuild
+	}
+
+	return storage.WriteDeltaCar(context.Background(), writer, linkSystemStorage{hc}, oldRoot, hc.link)
+}
+
+// linkSystemStorage reads and writes the blocks through the container link
+// system, so walks over the container are observed like its other reads
+type linkSystemStorage struct {
+	hc *HAMTContainer
+}
+
+func (ls linkSystemStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	return ls.hc.linkSystem.StorageReadOpener(lnkCtx, lnk)
+}
+
+func (ls linkSystemStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return ls.hc.linkSystem.StorageWriteOpener(lnkCtx)
+}
+
+// Prefetch prefetches through the container storage when it's a storage.Prefetcher
+func (ls linkSystemStorage) Prefetch(ctx context.Context, links []ipld.Link) error {
+	if prefetcher, ok := ls.hc.storage.(storage.Prefetcher); ok {
+		return prefetcher.Prefetch(ctx, links)
+	}
+	return nil
 }
@@ -1,14 +1,20 @@
 package hamtcontainer
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	ipfsApi "github.com/ipfs/go-ipfs-api"
 	ipld "github.com/ipld/go-ipld-prime"
 	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/ipfstest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -134,11 +140,12 @@ func TestHAMTContainerWithCachedKV(t *testing.T) {
 
 func TestHAMTContainerWithIPFS(t *testing.T) {
 	assert := assert.New(t)
+	// export IPFS_URL="http://localhost:5001" to test against a live node
 	ipfsURL, ok := os.LookupEnv("IPFS_URL")
 	if !ok {
-		// export IPFS_URL="http://localhost:5001"
-		fmt.Println("Pass IPFS_URL env in order to test IPFS connection")
-		return
+		server := ipfstest.NewServer()
+		defer server.Close()
+		ipfsURL = server.URL
 	}
 
 	store := storage.NewIPFSStorage(ipfsApi.NewShell(ipfsURL))
@@ -202,7 +209,7 @@ func TestUpdateHAMTContainer(t *testing.T) {
 
 	l1, err := hamt.GetLink()
 	assert.Nil(err)
-	assert.Equal("bafyrgqb5ccumyuwhlsulrr5yphx3t2fmd3dobftetwf4wk3f4twnkwj7kwhhwcs54b4tpfysgl6sefp4x2habf3oqnbtfqcshfkeod2s3ct3k", l1.String())
+	assert.Equal("bafyrgqddlqbng3p3ni25es5yxqyhdd2wi2q65lkmqbu4rcvozbkrnep6tl7mzx7kff4rdaxwg4ovnhbetrmjo25bbc33pklqprrkugtm56hzm", l1.String())
 
 	// Set some k/v
 	assert.Nil(hamt.MustBuild(func(hamtSetter HAMTSetter) error {
@@ -211,7 +218,7 @@ func TestUpdateHAMTContainer(t *testing.T) {
 
 	l2, err := hamt.GetLink()
 	assert.Nil(err)
-	assert.NotEqual("bafyrgqb5ccumyuwhlsulrr5yphx3t2fmd3dobftetwf4wk3f4twnkwj7kwhhwcs54b4tpfysgl6sefp4x2habf3oqnbtfqcshfkeod2s3ct3k", l2.String())
+	assert.NotEqual("bafyrgqddlqbng3p3ni25es5yxqyhdd2wi2q65lkmqbu4rcvozbkrnep6tl7mzx7kff4rdaxwg4ovnhbetrmjo25bbc33pklqprrkugtm56hzm", l2.String())
 
 	s1, err := hamt.GetAsString([]byte("foo"))
 	assert.Nil(err)
@@ -223,7 +230,7 @@ func TestUpdateHAMTContainer(t *testing.T) {
 
 	l3, err := hamt.GetLink()
 	assert.Nil(err)
-	assert.Equal("bafyrgqbhi5gpyypniliixeboianpfu7wqfp2w7mhstbzl2k72vya7kuj7nvwtdbaplkvadv5w5c4ywjnkofxpyuav7jeb6sewuww7b4k5qi64", l3.String())
+	assert.Equal("bafyrgqhuu5ezgu5tvf3upea56zpizpajvf4nkhtomyypafyypxlov5atetpuw4iwg5kr5iazvx3g4v5uibigtroenccxhnenpxrbqatnwdosg", l3.String())
 
 	// Set some k/v
 	assert.Nil(hamt.MustBuild(func(hamtSetter HAMTSetter) error {
@@ -236,7 +243,7 @@ func TestUpdateHAMTContainer(t *testing.T) {
 
 	l4, err := hamt.GetLink()
 	assert.Nil(err)
-	assert.Equal("bafyrgqg3c2hkug64cdlotx2yaxdekjx2s7rxjn734a2ohwfwzwwt5me3aqsv6skoyeksgi7iuecdzkrx6z37l7m73zwrurz2z644cyl35a4qe", l4.String())
+	assert.Equal("bafyrgqa5gqa3jajzpzuy3qbrwin3nc4xijuq4in4agwuvla2foaakmqyl5v5fnmibawgjlmyw7vtwzss3nntdfqadz27xmzzvcjphb6fspw4k", l4.String())
 }
 
 func TestNestedHAMTContainer(t *testing.T) {
@@ -282,3 +289,338 @@ func TestNestedHAMTContainer(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(val, "bar")
 }
+
+func TestHAMTContainerFromCarStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	childHAMT, err := NewHAMTBuilder(WithKey([]byte("child"))).Build()
+	assert.Nil(err)
+
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("zoo"), "zar")
+	}))
+
+	// Create the HAMT to snapshot, nesting the child
+	rootHAMT, err := NewHAMTBuilder(WithKey([]byte("root")), WithStorage(childHAMT.Storage())).Build()
+	assert.Nil(err)
+
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		if err := hamtSetter.Set([]byte("child"), childHAMT); err != nil {
+			return err
+		}
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	// Export it as a car file
+	path := filepath.Join(t.TempDir(), "root.car")
+	f, err := os.Create(path)
+	assert.Nil(err)
+	assert.Nil(rootHAMT.WriteCar(f))
+	assert.Nil(f.Close())
+
+	// Mount the car file as read only storage
+	store, err := storage.NewCarStorage(path)
+	assert.Nil(err)
+	defer store.Close()
+
+	lnk, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	newHC, err := NewHAMTBuilder(
+		WithStorage(store),
+		WithLink(lnk),
+	).Build()
+	assert.Nil(err)
+	assert.Equal("root", string(newHC.Key()))
+
+	val, err := newHC.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+
+	// The nested container is in the snapshot too
+	child, err := NewHAMTBuilder(WithKey([]byte("child")), WithHAMTContainer(newHC)).Build()
+	assert.Nil(err)
+
+	val, err = child.GetAsString([]byte("zoo"))
+	assert.Nil(err)
+	assert.Equal("zar", val)
+
+	// Snapshots can't be modified
+	assert.ErrorIs(newHC.MustBuild(), storage.ErrReadOnlyStorage)
+}
+
+func TestHAMTContainerFlushesBatchingStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := storage.NewMemoryStorage()
+	store := storage.NewBatchingStorage(inner)
+
+	rootHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithStorage(store),
+	).Build()
+	assert.Nil(err)
+
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	// The build was flushed into the wrapped storage
+	assert.Equal(0, store.Pending())
+
+	lnk, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	newHC, err := NewHAMTBuilder(
+		WithStorage(inner),
+		WithLink(lnk),
+	).Build()
+	assert.Nil(err)
+
+	val, err := newHC.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+}
+
+func TestHAMTContainerPrefetch(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingStorage{Storage: storage.NewMemoryStorage()}
+
+	childHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("child")),
+		WithStorage(inner),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	parentHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("parent")),
+		WithStorage(inner),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("child"), childHAMT)
+	}))
+
+	lnk, err := parentHAMT.GetLink()
+	assert.Nil(err)
+
+	// Load the parent through a cache
+	store := storage.NewCachedStorage(inner, 1<<20)
+	newParent, err := NewHAMTBuilder(
+		WithStorage(store),
+		WithLink(lnk),
+	).Build()
+	assert.Nil(err)
+
+	assert.Nil(newParent.Prefetch(context.Background()))
+	reads := atomic.LoadInt64(&inner.reads)
+
+	// The nested container is served by the cache
+	newChild, err := NewHAMTBuilder(
+		WithKey([]byte("child")),
+		WithHAMTContainer(newParent),
+	).Build()
+	assert.Nil(err)
+
+	val, err := newChild.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+	assert.Equal(reads, atomic.LoadInt64(&inner.reads))
+}
+
+// pinningStorage records the roots pinned by the containers
+type pinningStorage struct {
+	storage.Storage
+	pins [][2]ipld.Link
+}
+
+func (store *pinningStorage) PinRoot(_ context.Context, root ipld.Link, superseded ipld.Link) error {
+	store.pins = append(store.pins, [2]ipld.Link{root, superseded})
+	return nil
+}
+
+func TestHAMTContainerPinsRoots(t *testing.T) {
+	assert := assert.New(t)
+	store := &pinningStorage{Storage: storage.NewMemoryStorage()}
+
+	rootHAMT, err := NewHAMTBuilder(WithStorage(store)).Build()
+	assert.Nil(err)
+
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+	first, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("zoo"), "zar")
+	}))
+	second, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	assert.Equal([][2]ipld.Link{{first, nil}, {second, first}}, store.pins)
+}
+
+func TestHAMTContainerConcurrentBuildsShareMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+
+	containers := make([]*HAMTContainer, 4)
+	for i := range containers {
+		hamtContainer, err := NewHAMTBuilder(
+			WithKey([]byte(fmt.Sprintf("container-%d", i))),
+			WithStorage(store),
+		).Build()
+		assert.Nil(err)
+		containers[i] = hamtContainer
+	}
+
+	wg := sync.WaitGroup{}
+	for _, hamtContainer := range containers {
+		wg.Add(1)
+		go func(hamtContainer *HAMTContainer) {
+			defer wg.Done()
+			assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+				for i := 0; i < 32; i++ {
+					if err := hamtSetter.Set([]byte(fmt.Sprintf("key-%d", i)), "value"); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}(hamtContainer)
+	}
+	wg.Wait()
+
+	for _, hamtContainer := range containers {
+		lnk, err := hamtContainer.GetLink()
+		assert.Nil(err)
+
+		loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+		assert.Nil(err)
+
+		val, err := loaded.GetAsString([]byte("key-31"))
+		assert.Nil(err)
+		assert.Equal("value", val)
+	}
+}
+
+func TestHAMTContainerSyncNested(t *testing.T) {
+	assert := assert.New(t)
+
+	src := storage.NewMemoryStorage()
+
+	childHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("child")),
+		WithStorage(src),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	parentHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("parent")),
+		WithStorage(src),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("child"), childHAMT)
+	}))
+
+	lnk, err := parentHAMT.GetLink()
+	assert.Nil(err)
+
+	dst := storage.NewMemoryStorageWithOptions()
+	stats, err := storage.Sync(context.Background(), lnk, src, dst)
+	assert.Nil(err)
+	assert.Equal(int64(dst.Len()), stats.Copied)
+
+	// The nested container is loaded from the destination alone
+	newParent, err := NewHAMTBuilder(
+		WithStorage(dst),
+		WithLink(lnk),
+	).Build()
+	assert.Nil(err)
+
+	newChild, err := NewHAMTBuilder(
+		WithKey([]byte("child")),
+		WithHAMTContainer(newParent),
+	).Build()
+	assert.Nil(err)
+
+	val, err := newChild.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+}
+
+func TestHAMTContainerWriteDeltaCar(t *testing.T) {
+	assert := assert.New(t)
+
+	src := storage.NewMemoryStorageWithOptions()
+
+	buildChild := func(i int, value string) *HAMTContainer {
+		childHAMT, err := NewHAMTBuilder(WithKey([]byte(fmt.Sprintf("child-%d", i))), WithStorage(src)).Build()
+		assert.Nil(err)
+		assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+			for j := 0; j < 100; j++ {
+				if err := hamtSetter.Set([]byte(fmt.Sprintf("key-%d", j)), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		return childHAMT
+	}
+
+	parentHAMT, err := NewHAMTBuilder(WithKey([]byte("parent")), WithStorage(src)).Build()
+	assert.Nil(err)
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		for i := 0; i < 8; i++ {
+			if err := hamtSetter.Set([]byte(fmt.Sprintf("child-%d", i)), buildChild(i, "value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	oldRoot, err := parentHAMT.GetLink()
+	assert.Nil(err)
+
+	// The edge site holds the old containers
+	dst := storage.NewMemoryStorageWithOptions()
+	_, err = storage.Sync(context.Background(), oldRoot, src, dst)
+	assert.Nil(err)
+
+	// Only one of the nested containers changes
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("child-3"), buildChild(3, "changed"))
+	}))
+
+	full := bytes.Buffer{}
+	assert.Nil(parentHAMT.WriteDeltaCar(&full, nil))
+
+	delta := bytes.Buffer{}
+	assert.Nil(parentHAMT.WriteDeltaCar(&delta, oldRoot))
+	assert.Less(delta.Len(), full.Len()/2)
+
+	newRoot, err := storage.ApplyDeltaCar(context.Background(), &delta, dst)
+	assert.Nil(err)
+
+	loaded, err := NewHAMTBuilder(WithStorage(dst), WithLink(newRoot)).Build()
+	assert.Nil(err)
+
+	for i, expected := range map[int]string{3: "changed", 4: "value"} {
+		child, err := NewHAMTBuilder(WithKey([]byte(fmt.Sprintf("child-%d", i))), WithHAMTContainer(loaded)).Build()
+		assert.Nil(err)
+
+		val, err := child.GetAsString([]byte("key-42"))
+		assert.Nil(err)
+		assert.Equal(expected, val)
+	}
+}
@@ -0,0 +1,144 @@
+package hamtcontainer
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/utils"
+)
+
+var ErrHAMTInvalidRawKey = errors.New("Raw keys must be valid UTF-8")
+
+// KeyFormat is how the keys are written in the container
+type KeyFormat int
+
+const (
+	// Keys are hex encoded, the format of the containers built before KeyFormatRaw
+	KeyFormatHex KeyFormat = iota
+	// Keys are written as is, half the size of hex keys and no decoding on reads
+	// DAG-CBOR map keys are text, so raw keys must be valid UTF-8
+	KeyFormatRaw
+)
+
+func (f KeyFormat) String() string {
+	switch f {
+	case KeyFormatRaw:
+		return "raw"
+	default:
+		return "hex"
+	}
+}
+
+// encode returns the key as written in the container
+func (f KeyFormat) encode(key []byte) string {
+	if f == KeyFormatRaw {
+		return string(key)
+	}
+	return hex.EncodeToString(key)
+}
+
+// check fails with ErrHAMTInvalidRawKey for keys the format can't write
+func (f KeyFormat) check(key []byte) error {
+	if f == KeyFormatRaw && !utf8.Valid(key) {
+		return fmt.Errorf("%w: %q", ErrHAMTInvalidRawKey, key)
+	}
+	return nil
+}
+
+// decode returns the key written in the container
+func (f KeyFormat) decode(ks string) ([]byte, error) {
+	if f == KeyFormatRaw {
+		return []byte(ks), nil
+	}
+	return hex.DecodeString(ks)
+}
+
+// isMetaKey tells if the decoded key holds container metadata, only legacy containers have some
+func (hc *HAMTContainer) isMetaKey(key []byte) bool {
+	return hc.legacy && string(key) == reservedNameKey
+}
+
+// KeyFormat returns the format of the container keys
+func (hc *HAMTContainer) KeyFormat() KeyFormat {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	return hc.keyFormat
+}
+
+// MigrateKeyFormat rewrites the container with its keys in the given format
+// and builds it, values set but not built yet included. The container gets
+// a new link, so containers nesting it must be built again to link it.
+// It fails with ErrHAMTInvalidRawKey, leaving the container as it was, when
+// migrating keys which aren't valid UTF-8 to KeyFormatRaw.
+func (hc *HAMTContainer) MigrateKeyFormat(format KeyFormat) (err error) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	defer hc.observe(OpMigrateKeyFormat, &err)()
+
+	if hc.node == nil {
+		return ErrHAMTNotBuild
+	}
+
+	if hc.keyFormat == format {
+		return nil
+	}
+
+	kvCache := make(map[string]interface{}, len(hc.kvCache))
+	for ks, value := range hc.kvCache {
+		kb, err := hc.keyFormat.decode(ks)
+		if err != nil {
+			return err
+		}
+		if err := format.check(kb); err != nil {
+			return err
+		}
+		kvCache[format.encode(kb)] = value
+	}
+
+	// Like when built, the values of the container win over the ones not built yet
+	mapIter := hc.node.MapIterator()
+	for !mapIter.Done() {
+		key, value, err := mapIter.Next()
+		if err != nil {
+			return err
+		}
+
+		ks, err := key.AsString()
+		if err != nil {
+			return err
+		}
+
+		kb, err := hc.keyFormat.decode(ks)
+		if err != nil {
+			return err
+		}
+
+		if hc.isMetaKey(kb) {
+			continue
+		}
+
+		if err := format.check(kb); err != nil {
+			return err
+		}
+
+		val, err := utils.NodeValue(value)
+		if err != nil {
+			return err
+		}
+		kvCache[format.encode(kb)] = val
+	}
+
+	// Every value is in the cache, the container is built from scratch
+	prevFormat, prevCache, prevNode, prevLegacy := hc.keyFormat, hc.kvCache, hc.node, hc.legacy
+	hc.keyFormat, hc.kvCache, hc.node, hc.legacy = format, kvCache, nil, false
+
+	if err := hc.build(); err != nil {
+		hc.keyFormat, hc.kvCache, hc.node, hc.legacy = prevFormat, prevCache, prevNode, prevLegacy
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package hamtcontainer
+
+import (
+	"io/ioutil"
+	"testing"
+	"unicode/utf8"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertTextKeys checks every map key and string of the block is valid UTF-8,
+// as strict DAG-CBOR decoders require
+func assertTextKeys(t *testing.T, store storage.Storage, lnk ipld.Link) {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = store.OpenRead
+
+	node, err := lsys.Load(ipld.LinkContext{}, lnk, basicnode.Prototype.Any)
+	assert.Nil(t, err)
+
+	var walk func(node ipld.Node)
+	walk = func(node ipld.Node) {
+		switch node.Kind() {
+		case ipld.Kind_Map:
+			mapIter := node.MapIterator()
+			for !mapIter.Done() {
+				key, value, err := mapIter.Next()
+				assert.Nil(t, err)
+				ks, err := key.AsString()
+				assert.Nil(t, err)
+				assert.True(t, utf8.ValidString(ks), "%q", ks)
+				walk(value)
+			}
+		case ipld.Kind_List:
+			listIter := node.ListIterator()
+			for !listIter.Done() {
+				_, value, err := listIter.Next()
+				assert.Nil(t, err)
+				walk(value)
+			}
+		case ipld.Kind_String:
+			str, err := node.AsString()
+			assert.Nil(t, err)
+			assert.True(t, utf8.ValidString(str), "%q", str)
+		}
+	}
+	walk(node)
+}
+
+// rootSize returns the size of the container root block
+func rootSize(t *testing.T, hamtContainer *HAMTContainer) int {
+	lnk, err := hamtContainer.GetLink()
+	assert.Nil(t, err)
+
+	reader, err := hamtContainer.Storage().OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(t, err)
+
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	return len(data)
+}
+
+func TestHAMTContainerRawKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+	binaryKey := []byte{0x00, 0x01, 0xc3, 0xa9, 0x7f}
+	longKey := []byte("a rather long key, its hex encoding would double its size in every bucket")
+
+	build := func(format KeyFormat) *HAMTContainer {
+		hamtContainer, err := NewHAMTBuilder(
+			WithKey([]byte("root")),
+			WithStorage(store),
+			WithKeyFormat(format),
+		).Build()
+		assert.Nil(err)
+		assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+			if err := hamtSetter.Set(binaryKey, "binary"); err != nil {
+				return err
+			}
+			return hamtSetter.Set(longKey, "long")
+		}))
+		return hamtContainer
+	}
+
+	hexHAMT := build(KeyFormatHex)
+	rawHAMT := build(KeyFormatRaw)
+	assert.Equal(KeyFormatRaw, rawHAMT.KeyFormat())
+	assert.Less(rootSize(t, rawHAMT), rootSize(t, hexHAMT))
+
+	lnk, err := rawHAMT.GetLink()
+	assert.Nil(err)
+	assertTextKeys(t, store, lnk)
+
+	// The format is read back from the container, whatever the builder says
+	loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+	assert.Nil(err)
+	assert.Equal(KeyFormatRaw, loaded.KeyFormat())
+	assert.Equal([]byte("root"), loaded.Key())
+
+	val, err := loaded.GetAsString(binaryKey)
+	assert.Nil(err)
+	assert.Equal("binary", val)
+
+	keys := make(map[string]interface{})
+	assert.Nil(loaded.View(func(key []byte, value interface{}) error {
+		keys[string(key)] = value
+		return nil
+	}))
+	assert.Len(keys, 2)
+	assert.Contains(keys, string(binaryKey))
+	assert.Contains(keys, string(longKey))
+
+	// Later builds keep the format
+	loaded.Set([]byte("more"), "more")
+	assert.Nil(loaded.MustBuild())
+	lnk, err = loaded.GetLink()
+	assert.Nil(err)
+
+	hexLnk, err := hexHAMT.GetLink()
+	assert.Nil(err)
+	assert.Nil(loaded.LoadLink(hexLnk))
+	assert.Equal(KeyFormatHex, loaded.KeyFormat())
+	assert.Nil(loaded.LoadLink(lnk))
+	assert.Equal(KeyFormatRaw, loaded.KeyFormat())
+
+	val, err = loaded.GetAsString([]byte("more"))
+	assert.Nil(err)
+	assert.Equal("more", val)
+}
+
+func TestHAMTContainerRawKeysMustBeText(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+	invalidKey := []byte{0xff, 0x00, 0xc3, 0x28}
+
+	rawHAMT, err := NewHAMTBuilder(WithStorage(store), WithKeyFormat(KeyFormatRaw)).Build()
+	assert.Nil(err)
+
+	err = rawHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set(invalidKey, "value")
+	})
+	assert.ErrorIs(err, ErrHAMTInvalidRawKey)
+
+	// Set can't fail, the build does and drops the key
+	rawHAMT.Set(invalidKey, "value")
+	rawHAMT.Set([]byte("valid"), "value")
+	assert.ErrorIs(rawHAMT.MustBuild(), ErrHAMTInvalidRawKey)
+	assert.Nil(rawHAMT.MustBuild())
+
+	_, err = rawHAMT.Get(invalidKey)
+	assert.ErrorIs(err, ErrHAMTValueNotFound)
+	val, err := rawHAMT.GetAsString([]byte("valid"))
+	assert.Nil(err)
+	assert.Equal("value", val)
+
+	// Hex keys can hold anything, but can't be migrated to raw ones
+	hexHAMT, err := NewHAMTBuilder(WithStorage(store)).Build()
+	assert.Nil(err)
+	assert.Nil(hexHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set(invalidKey, "value")
+	}))
+	hexLnk, err := hexHAMT.GetLink()
+	assert.Nil(err)
+
+	assert.ErrorIs(hexHAMT.MigrateKeyFormat(KeyFormatRaw), ErrHAMTInvalidRawKey)
+	assert.Equal(KeyFormatHex, hexHAMT.KeyFormat())
+	lnk, err := hexHAMT.GetLink()
+	assert.Nil(err)
+	assert.Equal(hexLnk, lnk)
+
+	val, err = hexHAMT.GetAsString(invalidKey)
+	assert.Nil(err)
+	assert.Equal("value", val)
+}
+
+func TestHAMTContainerMigrateKeyFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+
+	childHAMT, err := NewHAMTBuilder(WithKey([]byte("child")), WithStorage(store)).Build()
+	assert.Nil(err)
+	assert.Nil(childHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	// Containers built before raw keys are hex keyed
+	parentHAMT, err := NewHAMTBuilder(WithKey([]byte("parent")), WithStorage(store)).Build()
+	assert.Nil(err)
+	assert.Nil(parentHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		if err := hamtSetter.Set([]byte("child"), childHAMT); err != nil {
+			return err
+		}
+		return hamtSetter.Set([]byte("bytes"), []byte("value"))
+	}))
+	assert.Equal(KeyFormatHex, parentHAMT.KeyFormat())
+
+	hexLnk, err := parentHAMT.GetLink()
+	assert.Nil(err)
+
+	// Values not built yet are migrated too
+	parentHAMT.Set([]byte("pending"), "value")
+	assert.Nil(parentHAMT.MigrateKeyFormat(KeyFormatRaw))
+	assert.Equal(KeyFormatRaw, parentHAMT.KeyFormat())
+
+	rawLnk, err := parentHAMT.GetLink()
+	assert.Nil(err)
+	assert.NotEqual(hexLnk, rawLnk)
+
+	loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(rawLnk)).Build()
+	assert.Nil(err)
+	assert.Equal(KeyFormatRaw, loaded.KeyFormat())
+	assert.Equal([]byte("parent"), loaded.Key())
+
+	for key, expected := range map[string]string{"bytes": "value", "pending": "value"} {
+		val, err := loaded.GetAsString([]byte(key))
+		assert.Nil(err)
+		assert.Equal(expected, val)
+	}
+
+	// Nested containers keep their own format
+	child, err := NewHAMTBuilder(WithKey([]byte("child")), WithHAMTContainer(loaded)).Build()
+	assert.Nil(err)
+	assert.Equal(KeyFormatHex, child.KeyFormat())
+
+	val, err := child.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+
+	// Migrating to the current format does nothing
+	assert.Nil(loaded.MigrateKeyFormat(KeyFormatRaw))
+	lnk, err := loaded.GetLink()
+	assert.Nil(err)
+	assert.Equal(rawLnk, lnk)
+
+	// The metadata lives apart from the entries, so no key is reserved
+	hexHAMT, err := NewHAMTBuilder(WithStorage(store)).Build()
+	assert.Nil(err)
+	assert.Nil(hexHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte(reservedNameKey), "value")
+	}))
+	assert.Nil(hexHAMT.MigrateKeyFormat(KeyFormatRaw))
+
+	val, err = hexHAMT.GetAsString([]byte(reservedNameKey))
+	assert.Nil(err)
+	assert.Equal("value", val)
+}
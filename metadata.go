@@ -0,0 +1,228 @@
+package hamtcontainer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+const (
+	// Containers whose metadata is held by magic keys among their entries
+	LegacyFormatVersion = 1
+	// Containers whose root wraps the metadata record and the entries
+	FormatVersion = 2
+)
+
+// Fields of the root written since FormatVersion 2
+const (
+	rootMetadataKey = "metadata"
+	rootEntriesKey  = "entries"
+)
+
+var ErrHAMTInvalidRoot = errors.New("Link isn't the root of a HAMT container")
+var ErrHAMTUnsupportedVersion = errors.New("Container format version not supported")
+
+// Metadata is the record describing a container, stored in its root
+type Metadata struct {
+	// The container key
+	Name []byte
+	// The format the container was built with
+	Version int64
+	// When the container was created, zero unless set with WithCreatedAt or SetMetadata
+	// It's written in the root, so containers with different times have different links
+	CreatedAt time.Time
+	// The HAMT params the container was built with, zero when unknown
+	BitWidth   int
+	BucketSize int
+	KeyFormat  KeyFormat
+	// Free for users, they're kept across builds
+	Labels map[string]string
+}
+
+// Metadata returns the metadata of the container, including the changes not built yet
+func (hc *HAMTContainer) Metadata() Metadata {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+
+	metadata := hc.metadata
+	metadata.Name = hc.key
+	metadata.KeyFormat = hc.keyFormat
+	metadata.Labels = copyLabels(hc.metadata.Labels)
+	return metadata
+}
+
+// SetMetadata sets the name, creation time and labels of the container, but like Set only when build
+// The version, HAMT params and key format are kept by the container,
+// use MigrateKeyFormat to change the key format
+func (hc *HAMTContainer) SetMetadata(metadata Metadata) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if len(metadata.Name) > 0 {
+		hc.key = metadata.Name
+	}
+	hc.metadata.CreatedAt = metadata.CreatedAt.UTC()
+	hc.metadata.Labels = copyLabels(metadata.Labels)
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// rootNode wraps the entries of the container with its metadata record
+func rootNode(metadata Metadata, entries ipld.Node) (ipld.Node, error) {
+	labels := make([]string, 0, len(metadata.Labels))
+	for label := range metadata.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	return fluent.BuildMap(basicnode.Prototype.Map, 2, func(ma fluent.MapAssembler) {
+		ma.AssembleEntry(rootMetadataKey).CreateMap(7, func(ma fluent.MapAssembler) {
+			ma.AssembleEntry("name").AssignBytes(metadata.Name)
+			ma.AssembleEntry("version").AssignInt(metadata.Version)
+			if !metadata.CreatedAt.IsZero() {
+				ma.AssembleEntry("createdAt").AssignString(metadata.CreatedAt.UTC().Format(time.RFC3339Nano))
+			}
+			ma.AssembleEntry("bitWidth").AssignInt(int64(metadata.BitWidth))
+			ma.AssembleEntry("bucketSize").AssignInt(int64(metadata.BucketSize))
+			ma.AssembleEntry("keyFormat").AssignString(metadata.KeyFormat.String())
+			ma.AssembleEntry("labels").CreateMap(int64(len(labels)), func(ma fluent.MapAssembler) {
+				for _, label := range labels {
+					ma.AssembleEntry(label).AssignString(metadata.Labels[label])
+				}
+			})
+		})
+		ma.AssembleEntry(rootEntriesKey).AssignNode(entries)
+	})
+}
+
+// readRoot returns the entries and metadata of a container root
+// Legacy roots are the entries themselves, holding the metadata under magic keys
+func readRoot(node ipld.Node) (ipld.Node, Metadata, bool, error) {
+	if node.Kind() != ipld.Kind_Map {
+		return nil, Metadata{}, false, ErrHAMTInvalidRoot
+	}
+
+	// Legacy roots always hold their name, their keys are hex
+	if name, err := node.LookupByString(KeyFormatHex.encode([]byte(reservedNameKey))); err == nil && name != nil {
+		nameBytes, err := name.AsBytes()
+		if err != nil {
+			return nil, Metadata{}, false, ErrHAMTInvalidRoot
+		}
+
+		return node, Metadata{
+			Name:      nameBytes,
+			Version:   LegacyFormatVersion,
+			KeyFormat: KeyFormatHex,
+		}, true, nil
+	}
+
+	metadataNode, err := node.LookupByString(rootMetadataKey)
+	if err != nil {
+		return nil, Metadata{}, false, ErrHAMTInvalidRoot
+	}
+
+	entries, err := node.LookupByString(rootEntriesKey)
+	if err != nil || entries.Kind() != ipld.Kind_Map {
+		return nil, Metadata{}, false, ErrHAMTInvalidRoot
+	}
+
+	metadata, err := readMetadata(metadataNode)
+	if err != nil {
+		return nil, Metadata{}, false, err
+	}
+
+	return entries, metadata, false, nil
+}
+
+func readMetadata(node ipld.Node) (Metadata, error) {
+	metadata := Metadata{Labels: make(map[string]string)}
+
+	mapIter := node.MapIterator()
+	if mapIter == nil {
+		return metadata, ErrHAMTInvalidRoot
+	}
+
+	for !mapIter.Done() {
+		key, value, err := mapIter.Next()
+		if err != nil {
+			return metadata, err
+		}
+
+		field, err := key.AsString()
+		if err != nil {
+			return metadata, err
+		}
+
+		switch field {
+		case "name":
+			metadata.Name, err = value.AsBytes()
+		case "version":
+			metadata.Version, err = value.AsInt()
+		case "createdAt":
+			var createdAt string
+			if createdAt, err = value.AsString(); err == nil {
+				metadata.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+			}
+		case "bitWidth":
+			var bitWidth int64
+			bitWidth, err = value.AsInt()
+			metadata.BitWidth = int(bitWidth)
+		case "bucketSize":
+			var bucketSize int64
+			bucketSize, err = value.AsInt()
+			metadata.BucketSize = int(bucketSize)
+		case "keyFormat":
+			var format string
+			if format, err = value.AsString(); err == nil {
+				switch format {
+				case KeyFormatHex.String():
+					metadata.KeyFormat = KeyFormatHex
+				case KeyFormatRaw.String():
+					metadata.KeyFormat = KeyFormatRaw
+				default:
+					err = fmt.Errorf("%w: unknown key format %q", ErrHAMTUnsupportedVersion, format)
+				}
+			}
+		case "labels":
+			labelsIter := value.MapIterator()
+			for labelsIter != nil && !labelsIter.Done() && err == nil {
+				var labelKey, labelValue ipld.Node
+				if labelKey, labelValue, err = labelsIter.Next(); err != nil {
+					break
+				}
+
+				var k, v string
+				if k, err = labelKey.AsString(); err != nil {
+					break
+				}
+				if v, err = labelValue.AsString(); err != nil {
+					break
+				}
+				metadata.Labels[k] = v
+			}
+		default:
+			// Unknown fields are left for later versions
+		}
+
+		if err != nil {
+			return metadata, err
+		}
+	}
+
+	if metadata.Version > FormatVersion {
+		return metadata, fmt.Errorf("%w: %d", ErrHAMTUnsupportedVersion, metadata.Version)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,187 @@
+package hamtcontainer
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multicodec"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeRoot stores a hand made container root, like the ones older versions built
+func storeRoot(t *testing.T, store storage.Storage, entries map[string]func(na fluent.NodeAssembler)) ipld.Link {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = store.OpenWrite
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_512),
+		MhLength: 64,
+	}}
+
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, int64(len(entries)), func(ma fluent.MapAssembler) {
+		for k, assign := range entries {
+			assign(ma.AssembleEntry(k))
+		}
+	})
+
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, n)
+	assert.Nil(t, err)
+	return lnk
+}
+
+func TestHAMTContainerMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	createdAt := time.Date(2021, 7, 22, 0, 0, 0, 0, time.UTC)
+
+	store := storage.NewMemoryStorage()
+	hamtContainer, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithStorage(store),
+		WithKeyFormat(KeyFormatRaw),
+		WithLabels(map[string]string{"owner": "team-a"}),
+		WithCreatedAt(createdAt),
+	).Build()
+	assert.Nil(err)
+
+	// The name isn't an entry anymore, so its key is free
+	assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte(reservedNameKey), "value")
+	}))
+
+	expected := Metadata{
+		Name:       []byte("root"),
+		Version:    FormatVersion,
+		CreatedAt:  createdAt,
+		BitWidth:   BitWidth,
+		BucketSize: BucketSize,
+		KeyFormat:  KeyFormatRaw,
+		Labels:     map[string]string{"owner": "team-a"},
+	}
+	assert.Equal(expected, hamtContainer.Metadata())
+
+	entries := 0
+	assert.Nil(hamtContainer.View(func(key []byte, value interface{}) error {
+		entries++
+		assert.Equal([]byte(reservedNameKey), key)
+		return nil
+	}))
+	assert.Equal(1, entries)
+
+	lnk, err := hamtContainer.GetLink()
+	assert.Nil(err)
+
+	loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+	assert.Nil(err)
+	assert.Equal(expected, loaded.Metadata())
+
+	// Name, creation time and labels change on the next build
+	loaded.SetMetadata(Metadata{
+		Name:      []byte("renamed"),
+		CreatedAt: createdAt.Add(time.Hour),
+		Labels:    map[string]string{"owner": "team-b"},
+	})
+	assert.Nil(loaded.MustBuild())
+
+	lnk, err = loaded.GetLink()
+	assert.Nil(err)
+
+	reloaded, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+	assert.Nil(err)
+
+	expected.Name = []byte("renamed")
+	expected.CreatedAt = createdAt.Add(time.Hour)
+	expected.Labels = map[string]string{"owner": "team-b"}
+	assert.Equal(expected, reloaded.Metadata())
+	assert.Equal([]byte("renamed"), reloaded.Key())
+
+	val, err := reloaded.GetAsString([]byte(reservedNameKey))
+	assert.Nil(err)
+	assert.Equal("value", val)
+}
+
+func TestHAMTContainerLegacyRoots(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+
+	// Legacy containers are hex keyed, holding their name among their entries
+	lnk := storeRoot(t, store, map[string]func(na fluent.NodeAssembler){
+		hex.EncodeToString([]byte(reservedNameKey)): func(na fluent.NodeAssembler) { na.AssignBytes([]byte("legacy")) },
+		hex.EncodeToString([]byte("foo")):           func(na fluent.NodeAssembler) { na.AssignString("bar") },
+	})
+
+	hamtContainer, err := NewHAMTBuilder(WithStorage(store), WithLink(lnk)).Build()
+	assert.Nil(err)
+	assert.Equal(Metadata{
+		Name:      []byte("legacy"),
+		Version:   LegacyFormatVersion,
+		KeyFormat: KeyFormatHex,
+		Labels:    map[string]string{},
+	}, hamtContainer.Metadata())
+
+	keys := 0
+	assert.Nil(hamtContainer.View(func(key []byte, value interface{}) error {
+		keys++
+		assert.Equal([]byte("foo"), key)
+		return nil
+	}))
+	assert.Equal(1, keys)
+
+	// Built again, the metadata moves out of the entries
+	assert.Nil(hamtContainer.MustBuild())
+
+	upgraded, err := hamtContainer.GetLink()
+	assert.Nil(err)
+
+	loaded, err := NewHAMTBuilder(WithStorage(store), WithLink(upgraded)).Build()
+	assert.Nil(err)
+
+	metadata := loaded.Metadata()
+	assert.Equal(int64(FormatVersion), metadata.Version)
+	assert.Equal([]byte("legacy"), metadata.Name)
+	assert.Equal(KeyFormatHex, metadata.KeyFormat)
+	assert.True(metadata.CreatedAt.IsZero())
+
+	val, err := loaded.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	assert.Equal("bar", val)
+
+	_, err = loaded.Get([]byte(reservedNameKey))
+	assert.ErrorIs(err, ErrHAMTValueNotFound)
+}
+
+func TestHAMTContainerInvalidRoots(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+
+	notContainer := storeRoot(t, store, map[string]func(na fluent.NodeAssembler){
+		"hello": func(na fluent.NodeAssembler) { na.AssignString("world") },
+	})
+	_, err := NewHAMTBuilder(WithStorage(store), WithLink(notContainer)).Build()
+	assert.ErrorIs(err, ErrHAMTInvalidRoot)
+
+	future := storeRoot(t, store, map[string]func(na fluent.NodeAssembler){
+		rootMetadataKey: func(na fluent.NodeAssembler) {
+			na.CreateMap(2, func(ma fluent.MapAssembler) {
+				ma.AssembleEntry("name").AssignBytes([]byte("future"))
+				ma.AssembleEntry("version").AssignInt(FormatVersion + 1)
+			})
+		},
+		rootEntriesKey: func(na fluent.NodeAssembler) {
+			na.CreateMap(0, func(fluent.MapAssembler) {})
+		},
+	})
+	_, err = NewHAMTBuilder(WithStorage(store), WithLink(future)).Build()
+	assert.ErrorIs(err, ErrHAMTUnsupportedVersion)
+}
@@ -0,0 +1,70 @@
+package hamtcontainer
+
+import (
+	"container/list"
+	"sync"
+
+	ipld "github.com/ipld/go-ipld-prime"
+)
+
+// NodeCache keeps decoded nodes indexed by their link
+// Nodes are immutable once built, so they can be shared between HAMTContainers
+type NodeCache interface {
+	Get(link ipld.Link) (ipld.Node, bool)
+	Add(link ipld.Link, node ipld.Node)
+}
+
+// DefaultNodeCache is the process-wide NodeCache, plug it with WithNodeCache
+var DefaultNodeCache = NewNodeCache(4096)
+
+type lruNodeCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[ipld.Link]*list.Element
+	lru        *list.List
+}
+
+type cachedNode struct {
+	link ipld.Link
+	node ipld.Node
+}
+
+// NewNodeCache creates a NodeCache keeping up to maxEntries of the most recently used nodes
+func NewNodeCache(maxEntries int) NodeCache {
+	return &lruNodeCache{
+		maxEntries: maxEntries,
+		entries:    make(map[ipld.Link]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (nc *lruNodeCache) Get(link ipld.Link) (ipld.Node, bool) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	elem, exists := nc.entries[link]
+	if !exists {
+		return nil, false
+	}
+
+	nc.lru.MoveToFront(elem)
+	return elem.Value.(*cachedNode).node, true
+}
+
+func (nc *lruNodeCache) Add(link ipld.Link, node ipld.Node) {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	if elem, exists := nc.entries[link]; exists {
+		nc.lru.MoveToFront(elem)
+		return
+	}
+
+	nc.entries[link] = nc.lru.PushFront(&cachedNode{link, node})
+
+	// Evict the least recently used nodes
+	for nc.lru.Len() > nc.maxEntries {
+		oldest := nc.lru.Remove(nc.lru.Back()).(*cachedNode)
+		delete(nc.entries, oldest.link)
+	}
+}
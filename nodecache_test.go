@@ -0,0 +1,89 @@
+package hamtcontainer
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+
+	ipld "github.com/ipld/go-ipld-prime"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the reads reaching the wrapped storage
+type countingStorage struct {
+	storage.Storage
+	reads int64
+}
+
+func (store *countingStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	atomic.AddInt64(&store.reads, 1)
+	return store.Storage.OpenRead(lnkCtx, lnk)
+}
+
+func TestNodeCacheSharedBetweenContainers(t *testing.T) {
+	assert := assert.New(t)
+	store := &countingStorage{Storage: storage.NewMemoryStorage()}
+
+	rootHAMT, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithStorage(store),
+	).Build()
+	assert.Nil(err)
+
+	assert.Nil(rootHAMT.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	lnk, err := rootHAMT.GetLink()
+	assert.Nil(err)
+
+	nodeCache := NewNodeCache(16)
+
+	// Open the same root a few times, only the first one should load it
+	for i := 0; i < 3; i++ {
+		hc, err := NewHAMTBuilder(
+			WithStorage(store),
+			WithLink(lnk),
+			WithNodeCache(nodeCache),
+		).Build()
+		assert.Nil(err)
+		assert.Equal("root", string(hc.Key()))
+
+		val, err := hc.GetAsString([]byte("foo"))
+		assert.Nil(err)
+		assert.Equal("bar", val)
+	}
+
+	assert.Equal(int64(1), atomic.LoadInt64(&store.reads))
+}
+
+func TestNodeCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+	nodeCache := NewNodeCache(2)
+
+	links := make([]ipld.Link, 3)
+	for i := range links {
+		hc, err := NewHAMTBuilder().Build()
+		assert.Nil(err)
+		assert.Nil(hc.MustBuild(func(hamtSetter HAMTSetter) error {
+			return hamtSetter.Set([]byte("foo"), []byte{byte(i)})
+		}))
+
+		links[i], err = hc.GetLink()
+		assert.Nil(err)
+
+		hc.mutex.RLock()
+		nodeCache.Add(links[i], hc.node)
+		hc.mutex.RUnlock()
+	}
+
+	// The first one is the least recently used
+	_, ok := nodeCache.Get(links[0])
+	assert.False(ok)
+
+	for _, lnk := range links[1:] {
+		_, ok := nodeCache.Get(lnk)
+		assert.True(ok)
+	}
+}
@@ -0,0 +1,195 @@
+package hamtcontainer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	ipld "github.com/ipld/go-ipld-prime"
+)
+
+// Operation names what an Event measured
+type Operation string
+
+const (
+	OpGet              Operation = "get"
+	OpView             Operation = "view"
+	OpMustBuild        Operation = "must_build"
+	OpLoadLink         Operation = "load_link"
+	OpWriteCar         Operation = "write_car"
+	OpWriteDeltaCar    Operation = "write_delta_car"
+	OpMigrateKeyFormat Operation = "migrate_key_format"
+	// Every block read from or written to the storage
+	OpStorageRead  Operation = "storage_read"
+	OpStorageWrite Operation = "storage_write"
+)
+
+// Event describes a finished container or storage operation
+// Blocks and Bytes count the storage traffic caused by the operation,
+// operations running concurrently on the same container may share it
+type Event struct {
+	Op  Operation
+	Key []byte
+	// The block read or written, the root built by MustBuild or loaded by LoadLink
+	Link     ipld.Link
+	Start    time.Time
+	Duration time.Duration
+	Blocks   int64
+	Bytes    int64
+	Err      error
+}
+
+// Observer is notified of every operation once finished
+// It's called synchronously, so it must be quick and safe for concurrent use
+type Observer interface {
+	Observe(event Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface
+type ObserverFunc func(event Event)
+
+// Observe calls f(event)
+func (f ObserverFunc) Observe(event Event) {
+	f(event)
+}
+
+// storageTraffic counts the blocks read and written through a container link system
+type storageTraffic struct {
+	blocks int64
+	bytes  int64
+}
+
+func (st *storageTraffic) add(size int) {
+	atomic.AddInt64(&st.blocks, 1)
+	atomic.AddInt64(&st.bytes, int64(size))
+}
+
+func (st *storageTraffic) snapshot() (int64, int64) {
+	return atomic.LoadInt64(&st.blocks), atomic.LoadInt64(&st.bytes)
+}
+
+// observe starts measuring op, the returned function reports it once done
+// It's meant to be deferred by methods with a named err result, holding the container mutex:
+//
+//	defer hc.observe(OpGet, &err)()
+func (hc *HAMTContainer) observe(op Operation, err *error) func() {
+	if hc.observer == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	blocks, bytes := hc.traffic.snapshot()
+
+	return func() {
+		endBlocks, endBytes := hc.traffic.snapshot()
+		hc.observer.Observe(Event{
+			Op:       op,
+			Key:      hc.key,
+			Link:     hc.link,
+			Start:    start,
+			Duration: time.Since(start),
+			Blocks:   endBlocks - blocks,
+			Bytes:    endBytes - bytes,
+			Err:      *err,
+		})
+	}
+}
+
+type observedKey struct{}
+
+// withObservedKey returns a link context reporting key in the storage events,
+// for the operations running without the container mutex, which can't read hc.key
+func withObservedKey(key []byte) ipld.LinkContext {
+	return ipld.LinkContext{Ctx: context.WithValue(context.Background(), observedKey{}, key)}
+}
+
+// eventKey returns the key reported in the storage events of the link context
+func (hc *HAMTContainer) eventKey(lnkCtx ipld.LinkContext) []byte {
+	if lnkCtx.Ctx != nil {
+		if key, ok := lnkCtx.Ctx.Value(observedKey{}).([]byte); ok {
+			return key
+		}
+	}
+	return hc.key
+}
+
+// observeLinkSystem reports every block read and written through the container link system
+func (hc *HAMTContainer) observeLinkSystem() {
+	readOpener := hc.linkSystem.StorageReadOpener
+	writeOpener := hc.linkSystem.StorageWriteOpener
+
+	hc.linkSystem.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		start := time.Now()
+
+		reader, err := readOpener(lnkCtx, lnk)
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(reader)
+		}
+
+		if err == nil {
+			hc.traffic.add(len(data))
+		}
+
+		hc.observer.Observe(Event{
+			Op:       OpStorageRead,
+			Key:      hc.eventKey(lnkCtx),
+			Link:     lnk,
+			Start:    start,
+			Duration: time.Since(start),
+			Blocks:   1,
+			Bytes:    int64(len(data)),
+			Err:      err,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	hc.linkSystem.StorageWriteOpener = func(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		start := time.Now()
+
+		writer, commit, err := writeOpener(lnkCtx)
+		if err != nil {
+			hc.observer.Observe(Event{Op: OpStorageWrite, Key: hc.eventKey(lnkCtx), Start: start, Duration: time.Since(start), Err: err})
+			return nil, nil, err
+		}
+
+		counter := &countingWriter{writer: writer}
+		return counter, func(lnk ipld.Link) error {
+			err := commit(lnk)
+			if err == nil {
+				hc.traffic.add(int(counter.written))
+			}
+
+			hc.observer.Observe(Event{
+				Op:       OpStorageWrite,
+				Key:      hc.eventKey(lnkCtx),
+				Link:     lnk,
+				Start:    start,
+				Duration: time.Since(start),
+				Blocks:   1,
+				Bytes:    counter.written,
+				Err:      err,
+			})
+
+			return err
+		}, nil
+	}
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,210 @@
+package hamtcontainer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingObserver keeps every event observed
+type recordingObserver struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (ro *recordingObserver) Observe(event Event) {
+	ro.mutex.Lock()
+	defer ro.mutex.Unlock()
+	ro.events = append(ro.events, event)
+}
+
+func (ro *recordingObserver) take(op Operation) []Event {
+	ro.mutex.Lock()
+	defer ro.mutex.Unlock()
+
+	var events []Event
+	for _, event := range ro.events {
+		if event.Op == op {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (ro *recordingObserver) reset() {
+	ro.mutex.Lock()
+	defer ro.mutex.Unlock()
+	ro.events = nil
+}
+
+func TestHAMTContainerObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	store := storage.NewMemoryStorage()
+	observer := &recordingObserver{}
+
+	hamtContainer, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithStorage(store),
+		WithObserver(observer),
+	).Build()
+	assert.Nil(err)
+
+	assert.Nil(hamtContainer.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("foo"), "bar")
+	}))
+
+	lnk, err := hamtContainer.GetLink()
+	assert.Nil(err)
+
+	// MustBuild reports the blocks it wrote
+	builds := observer.take(OpMustBuild)
+	writes := observer.take(OpStorageWrite)
+	assert.Len(builds, 1)
+	assert.NotEmpty(writes)
+	assert.Equal(lnk, builds[0].Link)
+	assert.Equal([]byte("root"), builds[0].Key)
+	assert.Equal(int64(len(writes)), builds[0].Blocks)
+	assert.Nil(builds[0].Err)
+
+	var written int64
+	for _, write := range writes {
+		assert.Equal(int64(1), write.Blocks)
+		written += write.Bytes
+	}
+	assert.Equal(written, builds[0].Bytes)
+	assert.False(builds[0].Start.IsZero())
+
+	_, err = hamtContainer.GetAsString([]byte("foo"))
+	assert.Nil(err)
+	_, err = hamtContainer.Get([]byte("missing"))
+	assert.ErrorIs(err, ErrHAMTValueNotFound)
+
+	gets := observer.take(OpGet)
+	assert.Len(gets, 2)
+	assert.Nil(gets[0].Err)
+	assert.ErrorIs(gets[1].Err, ErrHAMTValueNotFound)
+
+	assert.Nil(hamtContainer.View(func(key []byte, value interface{}) error { return nil }))
+	assert.Len(observer.take(OpView), 1)
+
+	assert.Nil(hamtContainer.WriteCar(&bytes.Buffer{}))
+	cars := observer.take(OpWriteCar)
+	assert.Len(cars, 1)
+	assert.Equal(int64(len(observer.take(OpStorageRead))), cars[0].Blocks)
+
+	// Delta exports read through the container too
+	observer.reset()
+	assert.Nil(hamtContainer.WriteDeltaCar(&bytes.Buffer{}, nil))
+	deltas := observer.take(OpWriteDeltaCar)
+	assert.Len(deltas, 1)
+	assert.NotZero(deltas[0].Blocks)
+	assert.Equal(int64(len(observer.take(OpStorageRead))), deltas[0].Blocks)
+
+	// Loading reports the blocks read
+	observer.reset()
+	_, err = NewHAMTBuilder(
+		WithStorage(store),
+		WithLink(lnk),
+		WithObserver(observer),
+	).Build()
+	assert.Nil(err)
+
+	loads := observer.take(OpLoadLink)
+	reads := observer.take(OpStorageRead)
+	assert.Len(loads, 1)
+	assert.Len(reads, 1)
+	assert.Equal(lnk, reads[0].Link)
+	assert.Equal(int64(1), loads[0].Blocks)
+	assert.Equal(reads[0].Bytes, loads[0].Bytes)
+}
+
+func TestHAMTContainerObserverStorageErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	observer := &recordingObserver{}
+	hamtContainer, err := NewHAMTBuilder(
+		WithStorage(storage.Chain(storage.NewMemoryStorage(), storage.ReadOnly())),
+		WithObserver(observer),
+	).Build()
+	assert.Nil(err)
+
+	assert.ErrorIs(hamtContainer.MustBuild(), storage.ErrReadOnlyStorage)
+
+	writes := observer.take(OpStorageWrite)
+	assert.NotEmpty(writes)
+	assert.ErrorIs(writes[0].Err, storage.ErrReadOnlyStorage)
+
+	builds := observer.take(OpMustBuild)
+	assert.Len(builds, 1)
+	assert.ErrorIs(builds[0].Err, storage.ErrReadOnlyStorage)
+}
+
+func TestNestedHAMTContainerInheritsObserver(t *testing.T) {
+	assert := assert.New(t)
+
+	observer := &recordingObserver{}
+	parent, err := NewHAMTBuilder(WithKey([]byte("parent")), WithObserver(observer)).Build()
+	assert.Nil(err)
+
+	child, err := NewHAMTBuilder(WithKey([]byte("child")), WithStorage(parent.Storage())).Build()
+	assert.Nil(err)
+	assert.Nil(child.MustBuild())
+
+	assert.Nil(parent.MustBuild(func(hamtSetter HAMTSetter) error {
+		return hamtSetter.Set([]byte("child"), child)
+	}))
+
+	observer.reset()
+	nested, err := NewHAMTBuilder(WithKey([]byte("child")), WithHAMTContainer(parent)).Build()
+	assert.Nil(err)
+	assert.Equal(observer, nested.observer)
+
+	loads := observer.take(OpLoadLink)
+	assert.Len(loads, 1)
+}
+
+func TestHAMTContainerObserverStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	observer := &recordingObserver{}
+	hamtContainer, err := NewHAMTBuilder(
+		WithKey([]byte("root")),
+		WithChunking(0, FixedSizeChunker(1<<10)),
+		WithObserver(observer),
+	).Build()
+	assert.Nil(err)
+	assert.Nil(hamtContainer.MustBuild())
+	observer.reset()
+
+	// Streams run without the container mutex while the key changes
+	streamed := make(chan struct{})
+	renamed := make(chan struct{})
+	go func() {
+		defer close(renamed)
+		for i := 0; ; i++ {
+			select {
+			case <-streamed:
+				return
+			default:
+				hamtContainer.SetMetadata(Metadata{Name: []byte(fmt.Sprintf("name-%d", i))})
+			}
+		}
+	}()
+
+	_, _, err = hamtContainer.SetReader([]byte("upload"), bytes.NewReader(randomBytes(256<<10, 7)))
+	assert.Nil(err)
+	close(streamed)
+	<-renamed
+
+	// Their storage events all report the key the stream started with
+	writes := observer.take(OpStorageWrite)
+	assert.NotEmpty(writes)
+	for _, write := range writes {
+		assert.Equal(writes[0].Key, write.Key)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+// Batching buffers every committed block in memory until Flush is called,
+// then writes them all at once, in a single round trip when the wrapped
+// storage is a BatchPutter. Reads of not yet flushed blocks are served
+// from the buffer.
+//
+// HAMTContainer.MustBuild flushes Flusher storages once the build is done,
+// even behind other storages like Verifying or Cached, so commits of a whole build end up in one batch:
+//
+//	store := storage.NewBatchingStorage(storage.NewRedisStorage("localhost:6379", ""))
+//	hamtcontainer.NewHAMTBuilder(hamtcontainer.WithStorage(store)).Build()
+type Batching struct {
+	inner Storage
+
+	mutex   sync.RWMutex
+	pending map[ipld.Link][]byte
+	order   []ipld.Link
+}
+
+// NewBatchingStorage creates a write batching storage in front of inner
+func NewBatchingStorage(inner Storage) *Batching {
+	return &Batching{
+		inner:   inner,
+		pending: make(map[ipld.Link][]byte),
+	}
+}
+
+// Pending returns how many blocks are waiting to be flushed
+func (store *Batching) Pending() int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return len(store.order)
+}
+
+// Flush writes every pending block to the wrapped storage
+// Blocks are kept pending if the write fails, so it can be retried
+func (store *Batching) Flush(ctx context.Context) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(store.order) == 0 {
+		return nil
+	}
+
+	blocks := make([]Block, 0, len(store.order))
+	for _, lnk := range store.order {
+		blocks = append(blocks, Block{Link: lnk, Data: store.pending[lnk]})
+	}
+
+	if err := putMany(ctx, store.inner, blocks); err != nil {
+		return err
+	}
+
+	store.pending = make(map[ipld.Link][]byte)
+	store.order = nil
+
+	return nil
+}
+
+func (store *Batching) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	store.mutex.RLock()
+	data, exists := store.pending[lnk]
+	store.mutex.RUnlock()
+
+	if exists {
+		return bytes.NewReader(data), nil
+	}
+
+	return store.inner.OpenRead(lnkCtx, lnk)
+}
+
+func (store *Batching) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		if _, exists := store.pending[lnk]; !exists {
+			store.order = append(store.order, lnk)
+		}
+		store.pending[lnk] = buf.Bytes()
+
+		return nil
+	}, nil
+}
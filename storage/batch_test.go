@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchCountingStorage counts the writes and batches reaching the wrapped memory storage
+type batchCountingStorage struct {
+	*Memory
+	writes  int
+	batches int
+}
+
+func (store *batchCountingStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	store.writes++
+	return store.Memory.OpenWrite(lnkCtx)
+}
+
+func (store *batchCountingStorage) PutMany(ctx context.Context, blocks []Block) error {
+	store.batches++
+	return store.Memory.PutMany(ctx, blocks)
+}
+
+func TestStorageBatchingFlush(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &batchCountingStorage{Memory: &Memory{}}
+	store := NewBatchingStorage(inner)
+
+	first := storeTestNode(t, store, "first")
+	second := storeTestNode(t, store, "second")
+	assert.Equal(2, store.Pending())
+
+	// Not flushed blocks are served from the buffer
+	_, err := store.OpenRead(ipld.LinkContext{}, first)
+	assert.Nil(err)
+	_, err = inner.OpenRead(ipld.LinkContext{}, first)
+	assert.ErrorIs(err, ErrDataNotFound)
+
+	assert.Nil(store.Flush(context.Background()))
+	assert.Equal(0, store.Pending())
+	assert.Equal(0, inner.writes)
+	assert.Equal(1, inner.batches)
+
+	for _, lnk := range []ipld.Link{first, second} {
+		_, err = inner.OpenRead(ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+	}
+
+	// Nothing left to flush
+	assert.Nil(store.Flush(context.Background()))
+	assert.Equal(1, inner.batches)
+}
+
+func TestStorageBatchingWithoutBatchPutter(t *testing.T) {
+	assert := assert.New(t)
+
+	// Hides the PutMany method of the memory storage
+	inner := &countingStorage{Storage: NewMemoryStorage()}
+	store := NewBatchingStorage(struct{ Storage }{inner})
+
+	lnk := storeTestNode(t, store, "world")
+	assert.Nil(store.Flush(context.Background()))
+
+	_, err := inner.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+}
+
+func TestStorageFlushWrapped(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &batchCountingStorage{Memory: &Memory{}}
+	batching := NewBatchingStorage(inner)
+	store := Chain(NewCachedStorage(NewVerifyingStorage(batching), 1<<20), Retry(2, 0))
+
+	lnk := storeTestNode(t, store, "wrapped")
+	assert.Equal(1, batching.Pending())
+
+	// Neither the cache nor the verifying storage is a Flusher, the batch is found behind them
+	assert.Nil(Flush(context.Background(), NewMirrorStorage(store)))
+	assert.Equal(0, batching.Pending())
+	assert.Equal(1, inner.batches)
+
+	_, err := inner.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+}
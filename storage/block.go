@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+// Block is the raw data stored for a link
+type Block struct {
+	Link ipld.Link
+	Data []byte
+}
+
+// BatchPutter is implemented by storages able to write many blocks in a single round trip
+type BatchPutter interface {
+	PutMany(ctx context.Context, blocks []Block) error
+}
+
+// MultiGetter is implemented by storages able to read many blocks in a single round trip
+// Blocks missing from the storage are left out of the result
+type MultiGetter interface {
+	GetMany(ctx context.Context, links []ipld.Link) ([]Block, error)
+}
+
+// Prefetcher is implemented by storages able to load blocks ahead of their reads
+type Prefetcher interface {
+	Prefetch(ctx context.Context, links []ipld.Link) error
+}
+
+// RootPinner is implemented by storages keeping container roots from being garbage collected
+// HAMTContainer.MustBuild calls it with the new root and the root it supersedes, if any
+type RootPinner interface {
+	PinRoot(ctx context.Context, root ipld.Link, superseded ipld.Link) error
+}
+
+// Flusher is implemented by storages buffering writes until flushed
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Haser is implemented by storages able to tell if they hold a block without reading it
+type Haser interface {
+	Has(ctx context.Context, lnk ipld.Link) (bool, error)
+}
+
+// Deleter is implemented by storages able to delete blocks
+// Deleting a missing block isn't an error
+type Deleter interface {
+	Delete(ctx context.Context, lnk ipld.Link) error
+}
+
+// Lister is implemented by storages able to enumerate their blocks
+// Iteration stops at the first error returned by fn, which List returns
+type Lister interface {
+	List(ctx context.Context, fn func(lnk ipld.Link) error) error
+}
+
+// wrapper is implemented by storages in front of other storages
+type wrapper interface {
+	unwrap() []Storage
+}
+
+// Flush flushes the storage when it's a Flusher, otherwise the storages it
+// wraps, so a Batching storage behind Verifying, Cached or a middleware Chain
+// is flushed too
+func Flush(ctx context.Context, store Storage) error {
+	if flusher, ok := store.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+
+	if w, ok := store.(wrapper); ok {
+		for _, inner := range w.unwrap() {
+			if err := Flush(ctx, inner); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close closes the storage when it's an io.Closer, otherwise the storages it
+// wraps, releasing the files and connections of the storages created by Open
+// Every wrapped storage is closed, the first error is returned
+func Close(store Storage) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	var firstErr error
+	if w, ok := store.(wrapper); ok {
+		for _, inner := range w.unwrap() {
+			if err := Close(inner); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// contextOf returns the context of the link context, direct calls may leave it unset
+func contextOf(lnkCtx ipld.LinkContext) context.Context {
+	if lnkCtx.Ctx == nil {
+		return context.Background()
+	}
+	return lnkCtx.Ctx
+}
+
+// readBlock reads the whole block data for lnk from the storage
+func readBlock(store Storage, lnkCtx ipld.LinkContext, lnk ipld.Link) ([]byte, error) {
+	reader, err := store.OpenRead(lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// writeBlock writes and commits the block data for lnk into the storage
+func writeBlock(store Storage, lnkCtx ipld.LinkContext, lnk ipld.Link, data []byte) error {
+	writer, commit, err := store.OpenWrite(lnkCtx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	return commit(lnk)
+}
+
+// putMany writes the blocks in a single batch when the storage supports it
+func putMany(ctx context.Context, store Storage, blocks []Block) error {
+	if batchPutter, ok := store.(BatchPutter); ok {
+		return batchPutter.PutMany(ctx, blocks)
+	}
+
+	for _, block := range blocks {
+		if err := writeBlock(store, ipld.LinkContext{Ctx: ctx}, block.Link, block.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+// Cached keeps an LRU of raw blocks in front of another storage.
+// Blocks are immutable by CID, so a cached block never goes stale,
+// the cache is only bounded by the configured amount of bytes.
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewCachedStorage(storage.NewRedisStorage("localhost:6379", ""), 64<<20)
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Cached struct {
+	inner        Storage
+	maxBytes     int64
+	writeThrough bool
+
+	mutex   sync.Mutex
+	size    int64
+	entries map[ipld.Link]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+type cachedBlock struct {
+	lnk  ipld.Link
+	data []byte
+}
+
+// CacheOption sets optional behaviours for the Cached storage
+type CacheOption func(*Cached)
+
+// CacheStats is a snapshot of the cache counters
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+// WithWriteThrough also caches every block committed through the storage
+func WithWriteThrough() CacheOption {
+	return func(c *Cached) {
+		c.writeThrough = true
+	}
+}
+
+// NewCachedStorage creates a cache holding up to maxBytes of blocks from inner
+func NewCachedStorage(inner Storage, maxBytes int64, options ...CacheOption) *Cached {
+	store := &Cached{
+		inner:    inner,
+		maxBytes: maxBytes,
+		entries:  make(map[ipld.Link]*list.Element),
+		lru:      list.New(),
+	}
+	for _, opt := range options {
+		opt(store)
+	}
+	return store
+}
+
+// Stats returns the current hit/miss counters and cache usage
+func (store *Cached) Stats() CacheStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return CacheStats{
+		Hits:    store.hits,
+		Misses:  store.misses,
+		Entries: store.lru.Len(),
+		Bytes:   store.size,
+	}
+}
+
+// Purge drops every cached block, counters are kept
+func (store *Cached) Purge() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.entries = make(map[ipld.Link]*list.Element)
+	store.lru.Init()
+	store.size = 0
+}
+
+func (store *Cached) get(lnk ipld.Link) ([]byte, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	elem, exists := store.entries[lnk]
+	if !exists {
+		store.misses++
+		return nil, false
+	}
+
+	store.hits++
+	store.lru.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+func (store *Cached) add(lnk ipld.Link, data []byte) {
+	// Blocks bigger than the whole cache are never kept
+	if int64(len(data)) > store.maxBytes {
+		return
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if elem, exists := store.entries[lnk]; exists {
+		store.lru.MoveToFront(elem)
+		return
+	}
+
+	store.entries[lnk] = store.lru.PushFront(&cachedBlock{lnk, data})
+	store.size += int64(len(data))
+
+	// Evict the least recently used blocks until we fit again
+	for store.size > store.maxBytes {
+		oldest := store.lru.Back()
+		block := store.lru.Remove(oldest).(*cachedBlock)
+		delete(store.entries, block.lnk)
+		store.size -= int64(len(block.data))
+	}
+}
+
+func (store *Cached) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	if data, ok := store.get(lnk); ok {
+		return bytes.NewReader(data), nil
+	}
+
+	reader, err := store.inner.OpenRead(lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	store.add(lnk, data)
+
+	return bytes.NewReader(data), nil
+}
+
+func (store *Cached) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	writer, commit, err := store.inner.OpenWrite(lnkCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !store.writeThrough {
+		return writer, commit, nil
+	}
+
+	buf := bytes.Buffer{}
+	return io.MultiWriter(writer, &buf), func(lnk ipld.Link) error {
+		if err := commit(lnk); err != nil {
+			return err
+		}
+
+		store.add(lnk, buf.Bytes())
+		return nil
+	}, nil
+}
+
+// GetMany serves the cached blocks and fetches the others from the wrapped storage
+// Misses are fetched in a single round trip when it's a MultiGetter
+func (store *Cached) GetMany(ctx context.Context, links []ipld.Link) ([]Block, error) {
+	blocks := make([]Block, 0, len(links))
+	var misses []ipld.Link
+
+	for _, lnk := range links {
+		if data, ok := store.get(lnk); ok {
+			blocks = append(blocks, Block{Link: lnk, Data: data})
+		} else {
+			misses = append(misses, lnk)
+		}
+	}
+
+	if len(misses) == 0 {
+		return blocks, nil
+	}
+
+	if multiGetter, ok := store.inner.(MultiGetter); ok {
+		fetched, err := multiGetter.GetMany(ctx, misses)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range fetched {
+			store.add(block.Link, block.Data)
+		}
+
+		return append(blocks, fetched...), nil
+	}
+
+	for _, lnk := range misses {
+		data, err := readBlock(store.inner, ipld.LinkContext{Ctx: ctx}, lnk)
+		if errors.Is(err, ErrDataNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		store.add(lnk, data)
+		blocks = append(blocks, Block{Link: lnk, Data: data})
+	}
+
+	return blocks, nil
+}
+
+// Prefetch loads the missing blocks into the cache ahead of their reads
+func (store *Cached) Prefetch(ctx context.Context, links []ipld.Link) error {
+	_, err := store.GetMany(ctx, links)
+	return err
+}
+
+func (store *Cached) unwrap() []Storage {
+	return []Storage{store.inner}
+}
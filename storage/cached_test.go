@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the reads reaching the wrapped storage
+type countingStorage struct {
+	Storage
+	reads int
+}
+
+func (store *countingStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	store.reads++
+	return store.Storage.OpenRead(lnkCtx, lnk)
+}
+
+func storeTestNode(t *testing.T, store Storage, value string) ipld.Link {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = store.OpenWrite
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_512),
+		MhLength: 64,
+	}}
+
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("hello").AssignString(value)
+	})
+
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, n)
+	assert.Nil(t, err)
+	return lnk
+}
+
+func TestStorageCachedRead(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingStorage{Storage: NewMemoryStorage()}
+	store := NewCachedStorage(inner, 1<<20)
+
+	lnk := storeTestNode(t, store, "world")
+
+	// First read misses, the following ones are served by the cache
+	for i := 0; i < 3; i++ {
+		r, err := store.OpenRead(ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+		_, err = ioutil.ReadAll(r)
+		assert.Nil(err)
+	}
+
+	assert.Equal(1, inner.reads)
+	stats := store.Stats()
+	assert.Equal(uint64(2), stats.Hits)
+	assert.Equal(uint64(1), stats.Misses)
+	assert.Equal(1, stats.Entries)
+
+	// Missing blocks are not cached
+	store.Purge()
+	_, err := store.OpenRead(ipld.LinkContext{}, storeTestNode(t, NewMemoryStorage(), "other"))
+	assert.ErrorIs(err, ErrDataNotFound)
+	assert.Equal(0, store.Stats().Entries)
+}
+
+func TestStorageCachedEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &countingStorage{Storage: NewMemoryStorage()}
+
+	// Room for a single block, both test nodes have the same size
+	first := storeTestNode(t, inner, "first")
+	r, err := inner.OpenRead(ipld.LinkContext{}, first)
+	assert.Nil(err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	inner.reads = 0
+
+	store := NewCachedStorage(inner, int64(len(data)), WithWriteThrough())
+
+	// Write through caches the block without reading it back
+	second := storeTestNode(t, store, "secnd")
+	_, err = store.OpenRead(ipld.LinkContext{}, second)
+	assert.Nil(err)
+	assert.Equal(0, inner.reads)
+
+	// Loading the first block evicts the second one
+	_, err = store.OpenRead(ipld.LinkContext{}, first)
+	assert.Nil(err)
+	assert.Equal(1, inner.reads)
+	assert.Equal(1, store.Stats().Entries)
+
+	_, err = store.OpenRead(ipld.LinkContext{}, second)
+	assert.Nil(err)
+	assert.Equal(2, inner.reads)
+}
+
+func TestStorageCachedGetMany(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := &batchCountingStorage{Memory: &Memory{}}
+	store := NewCachedStorage(inner, 1<<20)
+
+	first := storeTestNode(t, inner, "first")
+	second := storeTestNode(t, inner, "second")
+	missing := storeTestNode(t, NewMemoryStorage(), "missing")
+
+	blocks, err := store.GetMany(context.Background(), []ipld.Link{first, second, missing})
+	assert.Nil(err)
+	assert.Len(blocks, 2)
+	assert.Equal(uint64(3), store.Stats().Misses)
+
+	// Both blocks are served by the cache now
+	assert.Nil(store.Prefetch(context.Background(), []ipld.Link{first, second}))
+	assert.Equal(uint64(2), store.Stats().Hits)
+}
+
+// storeTestLinkNode stores a node linking to another one
+func storeTestLinkNode(t *testing.T, store Storage, value string, child ipld.Link) ipld.Link {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageWriteOpener = store.OpenWrite
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_512),
+		MhLength: 64,
+	}}
+
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 2, func(na fluent.MapAssembler) {
+		na.AssembleEntry("hello").AssignString(value)
+		na.AssembleEntry("child").AssignLink(child)
+	})
+
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, n)
+	assert.Nil(t, err)
+	return lnk
+}
+
+func mustReadBlock(t *testing.T, store Storage, lnk ipld.Link) []byte {
+	data, err := readBlock(store, ipld.LinkContext{}, lnk)
+	assert.Nil(t, err)
+	return data
+}
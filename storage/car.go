@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+)
+
+var ErrReadOnlyStorage = errors.New("Storage is read-only")
+var ErrInvalidCar = errors.New("Invalid or unsupported CAR file")
+
+const (
+	carV2PragmaSize = 11
+	carV2HeaderSize = 40
+
+	carIndexSorted          = 0x0400
+	carMultihashIndexSorted = 0x0401
+)
+
+// Car is a read-only storage serving blocks straight out of a CAR file.
+// CARv1 files are scanned once when opened, CARv2 files are served
+// through their embedded index (or scanned when they carry none).
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// the OpenWrite method always fails with ErrReadOnlyStorage.
+// It's meant to mount snapshots exported with HAMTContainer.WriteCar,
+// which hold every block of the container and of its nested containers:
+//
+//	store, _ := storage.NewCarStorage("/tmp/files.car")
+//	defer store.Close()
+//	hamtcontainer.NewHAMTBuilder(
+//		hamtcontainer.WithStorage(store),
+//		hamtcontainer.WithLink(cidlink.Link{Cid: store.Roots()[0]}),
+//	).Build()
+type Car struct {
+	file  *os.File
+	data  *io.SectionReader
+	roots []cid.Cid
+	// Section offsets relative to the CARv1 payload, keyed by multihash digest
+	offsets map[string]uint64
+}
+
+// NewCarStorage opens the CAR file at path as a read-only storage
+func NewCarStorage(path string) (*Car, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Car{file: file, offsets: make(map[string]uint64)}
+	if err := store.open(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *Car) open() error {
+	info, err := store.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := gocar.ReadHeader(bufio.NewReader(io.NewSectionReader(store.file, 0, info.Size())))
+	if err != nil {
+		return err
+	}
+
+	switch header.Version {
+	case 1:
+		store.data = io.NewSectionReader(store.file, 0, info.Size())
+		return store.scan()
+	case 2:
+		// Characteristics (16 bytes), data offset, data size and index offset
+		buf := make([]byte, carV2HeaderSize)
+		if _, err := store.file.ReadAt(buf, carV2PragmaSize); err != nil {
+			return err
+		}
+
+		dataOffset := binary.LittleEndian.Uint64(buf[16:24])
+		dataSize := binary.LittleEndian.Uint64(buf[24:32])
+		indexOffset := binary.LittleEndian.Uint64(buf[32:40])
+		store.data = io.NewSectionReader(store.file, int64(dataOffset), int64(dataSize))
+
+		inner, err := gocar.ReadHeader(bufio.NewReader(io.NewSectionReader(store.data, 0, int64(dataSize))))
+		if err != nil {
+			return err
+		}
+		store.roots = inner.Roots
+
+		if indexOffset == 0 {
+			return store.scan()
+		}
+
+		ok, err := store.readIndex(io.NewSectionReader(store.file, int64(indexOffset), info.Size()-int64(indexOffset)))
+		if err != nil {
+			return err
+		}
+
+		// Not an index format we know, fallback to scanning the payload
+		if !ok {
+			return store.scan()
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: version %d", ErrInvalidCar, header.Version)
+	}
+}
+
+// scan walks every section of the CARv1 payload recording its offset
+func (store *Car) scan() error {
+	reader := bufio.NewReader(io.NewSectionReader(store.data, 0, store.data.Size()))
+
+	header, err := gocar.ReadHeader(reader)
+	if err != nil {
+		return err
+	}
+	store.roots = header.Roots
+
+	headerSize, err := gocar.HeaderSize(header)
+	if err != nil {
+		return err
+	}
+
+	offset := headerSize
+	for {
+		section, err := carutil.LdRead(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		c, _, err := carutil.ReadCid(section)
+		if err != nil {
+			return err
+		}
+
+		digest, err := digestOf(c)
+		if err != nil {
+			return err
+		}
+
+		store.offsets[digest] = offset
+		offset += carutil.LdSize(section)
+	}
+}
+
+// readIndex loads a CARv2 IndexSorted or MultihashIndexSorted index
+// It returns false if the index codec isn't supported
+func (store *Car) readIndex(r io.Reader) (bool, error) {
+	reader := bufio.NewReader(r)
+
+	codec, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return false, err
+	}
+
+	switch codec {
+	case carIndexSorted:
+		return true, store.readMultiWidthIndex(reader)
+	case carMultihashIndexSorted:
+		var count int32
+		if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+			return false, err
+		}
+
+		for i := int32(0); i < count; i++ {
+			// Multihash code, digests are unique enough for our lookups
+			var code uint64
+			if err := binary.Read(reader, binary.LittleEndian, &code); err != nil {
+				return false, err
+			}
+
+			if err := store.readMultiWidthIndex(reader); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (store *Car) readMultiWidthIndex(reader io.Reader) error {
+	var buckets int32
+	if err := binary.Read(reader, binary.LittleEndian, &buckets); err != nil {
+		return err
+	}
+
+	for i := int32(0); i < buckets; i++ {
+		var width uint32
+		if err := binary.Read(reader, binary.LittleEndian, &width); err != nil {
+			return err
+		}
+
+		var size int64
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+
+		if width <= 8 || size < 0 || size%int64(width) != 0 {
+			return ErrInvalidCar
+		}
+
+		index := make([]byte, size)
+		if _, err := io.ReadFull(reader, index); err != nil {
+			return err
+		}
+
+		// Each entry is the digest followed by the little endian section offset
+		for entry := index; len(entry) > 0; entry = entry[width:] {
+			digestEnd := width - 8
+			store.offsets[string(entry[:digestEnd])] = binary.LittleEndian.Uint64(entry[digestEnd:width])
+		}
+	}
+
+	return nil
+}
+
+// Roots returns the roots declared by the CAR header
+func (store *Car) Roots() []cid.Cid {
+	return store.roots
+}
+
+// Close releases the underlying CAR file
+func (store *Car) Close() error {
+	return store.file.Close()
+}
+
+func (store *Car) OpenRead(_ ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	theCid, ok := lnk.(cidlink.Link)
+	if !ok {
+		return nil, fmt.Errorf("Attempted to load a non CID link: %v", lnk)
+	}
+
+	decoded, err := multihash.Decode(theCid.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	// Identity CIDs carry their data inline and are usually left out of indexes
+	if decoded.Code == multihash.IDENTITY {
+		return bytes.NewReader(decoded.Digest), nil
+	}
+
+	offset, exists := store.offsets[string(decoded.Digest)]
+	if !exists {
+		return nil, ErrDataNotFound
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(store.data, int64(offset), store.data.Size()-int64(offset)))
+	section, err := carutil.LdRead(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	c, n, err := carutil.ReadCid(section)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same digest with a different hash function isn't our block
+	if !bytes.Equal(c.Hash(), theCid.Hash()) {
+		return nil, ErrDataNotFound
+	}
+
+	return bytes.NewReader(section[n:]), nil
+}
+
+func (store *Car) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return nil, nil, ErrReadOnlyStorage
+}
+
+func digestOf(c cid.Cid) (string, error) {
+	decoded, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	return string(decoded.Digest), nil
+}
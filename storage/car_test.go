@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCarV1 stores a small node and returns its link with a CARv1 containing it
+func writeTestCarV1(t *testing.T) (ipld.Link, []byte) {
+	lsys := cidlink.DefaultLinkSystem()
+	store := NewMemoryStorage()
+	lsys.StorageWriteOpener = store.OpenWrite
+	lsys.StorageReadOpener = store.OpenRead
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_512),
+		MhLength: 64,
+	}}
+
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("hello").AssignString("world")
+	})
+
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, n)
+	assert.Nil(t, err)
+
+	r, err := store.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+
+	c := lnk.(cidlink.Link).Cid
+	buf := bytes.Buffer{}
+	assert.Nil(t, gocar.WriteHeader(&gocar.CarHeader{Roots: []cid.Cid{c}, Version: 1}, &buf))
+	assert.Nil(t, carutil.LdWrite(&buf, c.Bytes(), data))
+
+	return lnk, buf.Bytes()
+}
+
+// wrapTestCarV2 wraps a CARv1 payload into a CARv2 with an optional IndexSorted index
+func wrapTestCarV2(t *testing.T, v1 []byte, lnk ipld.Link, withIndex bool) []byte {
+	buf := bytes.Buffer{}
+	buf.Write([]byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02})
+
+	dataOffset := uint64(carV2PragmaSize + carV2HeaderSize)
+	indexOffset := uint64(0)
+	if withIndex {
+		indexOffset = dataOffset + uint64(len(v1))
+	}
+
+	header := make([]byte, carV2HeaderSize)
+	binary.LittleEndian.PutUint64(header[16:], dataOffset)
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(v1)))
+	binary.LittleEndian.PutUint64(header[32:], indexOffset)
+	buf.Write(header)
+	buf.Write(v1)
+
+	if withIndex {
+		decoded, err := multihash.Decode(lnk.(cidlink.Link).Hash())
+		assert.Nil(t, err)
+
+		// The only section starts right after the CARv1 header
+		roots := []cid.Cid{lnk.(cidlink.Link).Cid}
+		headerSize, err := gocar.HeaderSize(&gocar.CarHeader{Roots: roots, Version: 1})
+		assert.Nil(t, err)
+
+		entry := append(append([]byte{}, decoded.Digest...), make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(entry[len(decoded.Digest):], headerSize)
+
+		buf.Write([]byte{0x80, 0x08}) // IndexSorted codec as varint
+		binary.Write(&buf, binary.LittleEndian, int32(1))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(entry)))
+		binary.Write(&buf, binary.LittleEndian, int64(len(entry)))
+		buf.Write(entry)
+	}
+
+	return buf.Bytes()
+}
+
+func TestStorageCarRead(t *testing.T) {
+	assert := assert.New(t)
+
+	lnk, v1 := writeTestCarV1(t)
+	dir := t.TempDir()
+
+	files := map[string][]byte{
+		"v1.car":           v1,
+		"v2-indexless.car": wrapTestCarV2(t, v1, lnk, false),
+		"v2-indexed.car":   wrapTestCarV2(t, v1, lnk, true),
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(os.WriteFile(path, content, 0644))
+
+		store, err := NewCarStorage(path)
+		assert.Nil(err, name)
+		assert.Equal([]cid.Cid{lnk.(cidlink.Link).Cid}, store.Roots(), name)
+
+		// Load the node through a link system backed by the CAR
+		lsys := cidlink.DefaultLinkSystem()
+		lsys.StorageReadOpener = store.OpenRead
+
+		n, err := lsys.Load(ipld.LinkContext{}, lnk, basicnode.Prototype.Any)
+		assert.Nil(err, name)
+
+		v, err := n.LookupByString("hello")
+		assert.Nil(err, name)
+		s, err := v.AsString()
+		assert.Nil(err, name)
+		assert.Equal("world", s, name)
+
+		assert.Nil(store.Close())
+	}
+}
+
+func TestStorageCarReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	_, v1 := writeTestCarV1(t)
+	path := filepath.Join(t.TempDir(), "file.car")
+	assert.Nil(os.WriteFile(path, v1, 0644))
+
+	store, err := NewCarStorage(path)
+	assert.Nil(err)
+	defer store.Close()
+
+	_, _, err = store.OpenWrite(ipld.LinkContext{})
+	assert.ErrorIs(err, ErrReadOnlyStorage)
+
+	// Unknown blocks are reported as not found
+	missing, err := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_512),
+		MhLength: 64,
+	}.Sum([]byte("missing"))
+	assert.Nil(err)
+	_, err = store.OpenRead(ipld.LinkContext{}, cidlink.Link{Cid: missing})
+	assert.ErrorIs(err, ErrDataNotFound)
+}
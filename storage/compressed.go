@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/multiformats/go-multicodec"
+)
+
+var ErrUnsupportedCompression = errors.New("Unsupported compression algorithm")
+
+// CompressionAlgorithm identifies how a block was compressed
+// It's stored right after compressionMagic in every block written by the Compressed storage
+type CompressionAlgorithm byte
+
+// compressionMagic starts every block written by the Compressed storage
+// 0xff is a CBOR break, invalid UTF-8 and an unused protobuf tag, so no
+// dag-cbor, dag-json or dag-pb block written without the wrapper starts with it
+var compressionMagic = []byte{0xff, 'h', 'z'}
+
+const (
+	CompressionNone CompressionAlgorithm = iota
+	CompressionGzip
+	CompressionZstd
+	CompressionSnappy
+)
+
+// Shared zstd encoder and decoder, both are safe for concurrent use of EncodeAll/DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// CompressionStats is a snapshot of the compression counters
+type CompressionStats struct {
+	// Bytes of blocks before compression
+	RawBytes uint64
+	// Bytes actually written to the wrapped storage
+	StoredBytes uint64
+}
+
+// Ratio returns how many raw bytes were written for each stored byte
+func (cs CompressionStats) Ratio() float64 {
+	if cs.StoredBytes == 0 {
+		return 0
+	}
+	return float64(cs.RawBytes) / float64(cs.StoredBytes)
+}
+
+// Compressed compresses blocks before writing them to another storage.
+// Every block is prefixed by a magic header with its CompressionAlgorithm,
+// so stores written with different algorithms remain readable. Blocks not
+// starting with the header are returned untouched, which keeps blocks
+// written before the wrapper was introduced readable as well. Those of
+// other codecs, like raw, may start with the header by chance, so their
+// decompressed data is checked against their CID before being returned.
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewCompressedStorage(redisStore, storage.CompressionZstd)
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Compressed struct {
+	inner       Storage
+	algo        CompressionAlgorithm
+	rawBytes    uint64
+	storedBytes uint64
+}
+
+// NewCompressedStorage creates a storage compressing blocks written to inner with algo
+func NewCompressedStorage(inner Storage, algo CompressionAlgorithm) *Compressed {
+	return &Compressed{inner: inner, algo: algo}
+}
+
+// Stats returns the amount of bytes written before and after compression
+func (store *Compressed) Stats() CompressionStats {
+	return CompressionStats{
+		RawBytes:    atomic.LoadUint64(&store.rawBytes),
+		StoredBytes: atomic.LoadUint64(&store.storedBytes),
+	}
+}
+
+func compress(algo CompressionAlgorithm, data []byte) ([]byte, error) {
+	header := append(append([]byte{}, compressionMagic...), byte(algo))
+
+	switch algo {
+	case CompressionNone:
+		return append(header, data...), nil
+	case CompressionGzip:
+		buf := bytes.NewBuffer(header)
+		writer := gzip.NewWriter(buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, header), nil
+	case CompressionSnappy:
+		return append(header, snappy.Encode(nil, data)...), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, algo)
+	}
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressionMagic) || len(data) == len(compressionMagic) {
+		// Written without the compression wrapper
+		return data, nil
+	}
+
+	algo, body := CompressionAlgorithm(data[len(compressionMagic)]), data[len(compressionMagic)+1:]
+	switch algo {
+	case CompressionNone:
+		return body, nil
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(body, nil)
+	case CompressionSnappy:
+		return snappy.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedCompression, algo)
+	}
+}
+
+// headerMayCollide tells if blocks of the link codec may start with compressionMagic
+// without having been written by the Compressed storage
+func headerMayCollide(lnk ipld.Link) bool {
+	theCid, ok := lnk.(cidlink.Link)
+	if !ok {
+		return true
+	}
+
+	switch theCid.Prefix().Codec {
+	case uint64(multicodec.DagCbor), uint64(multicodec.DagJson), uint64(multicodec.DagPb):
+		return false
+	}
+	return true
+}
+
+func (store *Compressed) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	data, err := readBlock(store.inner, lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := decompress(data)
+	if headerMayCollide(lnk) && bytes.HasPrefix(data, compressionMagic) {
+		// Only the CID tells a compressed block from a legacy one starting like it
+		if err != nil || VerifyBlock(lnk, decompressed) != nil {
+			if VerifyBlock(lnk, data) == nil {
+				decompressed, err = data, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = decompressed
+
+	return bytes.NewReader(data), nil
+}
+
+func (store *Compressed) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		data, err := compress(store.algo, buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		// Not worth it for small or incompressible blocks
+		if len(data) > buf.Len()+len(compressionMagic)+1 {
+			data, _ = compress(CompressionNone, buf.Bytes())
+		}
+
+		if err := writeBlock(store.inner, lnkCtx, lnk, data); err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&store.rawBytes, uint64(buf.Len()))
+		atomic.AddUint64(&store.storedBytes, uint64(len(data)))
+
+		return nil
+	}, nil
+}
+
+func (store *Compressed) unwrap() []Storage {
+	return []Storage{store.inner}
+}
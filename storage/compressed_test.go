@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageCompressedRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	value := string(bytes.Repeat([]byte("compressible "), 100))
+
+	lnks := make(map[CompressionAlgorithm]ipld.Link)
+	for _, algo := range []CompressionAlgorithm{CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy} {
+		store := NewCompressedStorage(inner, algo)
+		lnks[algo] = storeTestNode(t, store, value+string(rune('a'+algo)))
+
+		raw, err := readBlock(inner, ipld.LinkContext{}, lnks[algo])
+		assert.Nil(err)
+		assert.Equal(append(append([]byte{}, compressionMagic...), byte(algo)), raw[:len(compressionMagic)+1])
+
+		if algo != CompressionNone {
+			assert.True(store.Stats().Ratio() > 1, algo)
+		}
+	}
+
+	// Any algorithm reads the blocks written by the others
+	store := NewCompressedStorage(inner, CompressionZstd)
+	for algo, lnk := range lnks {
+		data, err := readBlock(store, ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+		assert.True(bytes.Contains(data, []byte(value+string(rune('a'+algo)))))
+	}
+}
+
+func TestStorageCompressedReadsUncompressedBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	lnk := storeTestNode(t, inner, "world")
+
+	// Blocks written before wrapping the storage are still readable
+	expected, err := readBlock(inner, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	data, err := readBlock(NewCompressedStorage(inner, CompressionGzip), ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	assert.Equal(expected, data)
+}
+
+func TestStorageCompressedReadsLegacyRawBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	prefix := cid.Prefix{Version: 1, Codec: uint64(multicodec.Raw), MhType: uint64(multicodec.Sha2_256), MhLength: -1}
+	inner := NewMemoryStorage()
+	store := NewCompressedStorage(inner, CompressionNone)
+
+	// Raw blocks may start with anything, the compression header included
+	for _, data := range [][]byte{
+		{byte(CompressionGzip), 'r', 'a', 'w'},
+		append(append([]byte{}, compressionMagic...), byte(CompressionNone), 'r', 'a', 'w'),
+		append(append([]byte{}, compressionMagic...), byte(CompressionGzip), 'r', 'a', 'w'),
+	} {
+		theCid, err := prefix.Sum(data)
+		assert.Nil(err)
+		lnk := cidlink.Link{Cid: theCid}
+		assert.Nil(writeBlock(inner, ipld.LinkContext{}, lnk, data))
+
+		read, err := readBlock(store, ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+		assert.Equal(data, read)
+	}
+
+	// Compressed raw blocks are still decompressed
+	data := bytes.Repeat([]byte("raw "), 100)
+	theCid, err := prefix.Sum(data)
+	assert.Nil(err)
+	lnk := cidlink.Link{Cid: theCid}
+	assert.Nil(writeBlock(NewCompressedStorage(inner, CompressionGzip), ipld.LinkContext{}, lnk, data))
+
+	read, err := readBlock(store, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	assert.Equal(data, read)
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/ipfstest"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/storagetest"
+)
+
+func newMiniredisStorage(t *testing.T) storage.Storage {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	return storage.NewRedisStorage(server.Addr(), "")
+}
+
+func TestConformanceMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestConformanceMemoryMaxBytes(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorageWithOptions(storage.WithMaxBytes(16 << 20))
+	})
+}
+
+func TestConformanceRedis(t *testing.T) {
+	storagetest.Run(t, newMiniredisStorage)
+}
+
+func TestConformanceRedisRefCounting(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+
+		store, err := storage.NewRedisStorageWithOptions(
+			storage.WithRedisURL("redis://"+server.Addr()),
+			storage.WithKeyPrefix("tenant:"),
+			storage.WithRefCounting(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+// export REDIS_HOST="localhost:6379" to run the suite against a live Redis
+func TestConformanceRedisLive(t *testing.T) {
+	redisHost, ok := os.LookupEnv("REDIS_HOST")
+	if !ok {
+		t.Skip("Pass REDIS_HOST env in order to test Redis connection")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewRedisStorage(redisHost, os.Getenv("REDIS_PASSWORD"))
+	})
+}
+
+func TestConformanceIPFS(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		server := ipfstest.NewServer()
+		t.Cleanup(server.Close)
+		return storage.NewIPFSStorage(server.Shell())
+	})
+}
+
+func TestConformanceCached(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewCachedStorage(newMiniredisStorage(t), 1<<20, storage.WithWriteThrough())
+	})
+}
+
+func TestConformanceBatching(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewBatchingStorage(newMiniredisStorage(t))
+	})
+}
+
+func TestConformanceMirror(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMirrorStorage(newMiniredisStorage(t), newMiniredisStorage(t)).WithReadRepair()
+	})
+}
+
+func TestConformanceEncrypted(t *testing.T) {
+	keys := storage.NewStaticKeyProvider("k1", map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+	})
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewEncryptedStorage(newMiniredisStorage(t), keys)
+	})
+}
+
+func TestConformanceCompressed(t *testing.T) {
+	for name, algo := range map[string]storage.CompressionAlgorithm{
+		"Gzip":   storage.CompressionGzip,
+		"Zstd":   storage.CompressionZstd,
+		"Snappy": storage.CompressionSnappy,
+	} {
+		algo := algo
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.Storage {
+				return storage.NewCompressedStorage(newMiniredisStorage(t), algo)
+			})
+		})
+	}
+}
+
+func TestConformanceVerifying(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewVerifyingStorage(newMiniredisStorage(t))
+	})
+}
+
+func TestConformanceChain(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.Chain(newMiniredisStorage(t),
+			storage.Retry(3, time.Millisecond),
+			storage.Timeout(time.Second),
+			storage.ConcurrencyLimit(4),
+		)
+	})
+}
+
+func TestConformanceSharded(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewShardedStorage(newMiniredisStorage(t), newMiniredisStorage(t), newMiniredisStorage(t))
+	})
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+var ErrIncompleteDelta = errors.New("Delta doesn't complete the root, blocks are missing")
+
+// WriteDeltaCar writes a CARv1 file rooted at newRoot holding only the blocks
+// reachable from newRoot but not from oldRoot. A nil oldRoot writes every block.
+//
+// Unchanged subtrees keep their links, so the blocks under oldRoot are only
+// read to be left out and a one key change ships a handful of blocks.
+func WriteDeltaCar(ctx context.Context, w io.Writer, store Storage, oldRoot ipld.Link, newRoot ipld.Link) error {
+	newCid, ok := newRoot.(cidlink.Link)
+	if !ok {
+		return fmt.Errorf("Attempted to write a delta for a non CID link: %v", newRoot)
+	}
+
+	old := make(map[ipld.Link]struct{})
+	if oldRoot != nil {
+		err := Walk(ctx, store, oldRoot, func(lnk ipld.Link, _ []byte) (bool, error) {
+			old[lnk] = struct{}{}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer := bufio.NewWriter(w)
+	if err := gocar.WriteHeader(&gocar.CarHeader{Roots: []cid.Cid{newCid.Cid}, Version: 1}, writer); err != nil {
+		return err
+	}
+
+	err := Walk(ctx, store, newRoot, func(lnk ipld.Link, data []byte) (bool, error) {
+		// The receiver has it along with everything it links to
+		if _, exists := old[lnk]; exists {
+			return false, nil
+		}
+
+		return true, carutil.LdWrite(writer, lnk.(cidlink.Link).Bytes(), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// ApplyDeltaCar imports the blocks of a CAR file written by WriteDeltaCar and
+// returns its root. Every block is checked against its link, then the whole
+// DAG under the root is walked to make sure no block is missing from the
+// storage, failing with ErrIncompleteDelta otherwise.
+func ApplyDeltaCar(ctx context.Context, r io.Reader, store Storage) (ipld.Link, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := gocar.ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Version != 1 || len(header.Roots) != 1 {
+		return nil, ErrInvalidCar
+	}
+
+	var blocks []Block
+	for {
+		section, err := carutil.LdRead(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		c, n, err := carutil.ReadCid(section)
+		if err != nil {
+			return nil, err
+		}
+
+		block := Block{Link: cidlink.Link{Cid: c}, Data: section[n:]}
+		if err := VerifyBlock(block.Link, block.Data); err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if err := putMany(ctx, store, blocks); err != nil {
+		return nil, err
+	}
+
+	if err := Flush(ctx, store); err != nil {
+		return nil, err
+	}
+
+	root := cidlink.Link{Cid: header.Roots[0]}
+	err = Walk(ctx, store, root, func(ipld.Link, []byte) (bool, error) {
+		return true, nil
+	})
+	if errors.Is(err, ErrDataNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrIncompleteDelta, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageDeltaCar(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	src := NewMemoryStorageWithOptions()
+	leaf := storeTestNode(t, src, "leaf")
+	oldRoot := storeTestLinkNode(t, src, "old", storeTestLinkNode(t, src, "middle", leaf))
+	newRoot := storeTestLinkNode(t, src, "new", storeTestLinkNode(t, src, "changed", leaf))
+
+	// The receiver only holds the old DAG
+	dst := NewMemoryStorageWithOptions()
+	_, err := Sync(ctx, oldRoot, src, dst)
+	assert.Nil(err)
+
+	delta := bytes.Buffer{}
+	assert.Nil(WriteDeltaCar(ctx, &delta, src, oldRoot, newRoot))
+
+	// The leaf is shared with the old root, only the new root and its child are shipped
+	applied := NewMemoryStorageWithOptions()
+	_, err = applied.Load(bytes.NewReader(delta.Bytes()))
+	assert.Nil(err)
+	assert.Equal(2, applied.Len())
+
+	root, err := ApplyDeltaCar(ctx, bytes.NewReader(delta.Bytes()), dst)
+	assert.Nil(err)
+	assert.Equal(newRoot, root)
+	assert.Equal(5, dst.Len())
+
+	// Without the old DAG the delta doesn't complete the root
+	_, err = ApplyDeltaCar(ctx, bytes.NewReader(delta.Bytes()), NewMemoryStorage())
+	assert.ErrorIs(err, ErrIncompleteDelta)
+
+	// A nil old root ships everything
+	full := bytes.Buffer{}
+	assert.Nil(WriteDeltaCar(ctx, &full, src, nil, newRoot))
+	root, err = ApplyDeltaCar(ctx, &full, NewMemoryStorage())
+	assert.Nil(err)
+	assert.Equal(newRoot, root)
+}
+
+func TestStorageDeltaCarCorrupted(t *testing.T) {
+	ctx := context.Background()
+
+	src := NewMemoryStorageWithOptions()
+	root := storeTestLinkNode(t, src, "root", storeTestNode(t, src, "leaf"))
+
+	delta := bytes.Buffer{}
+	assert.Nil(t, WriteDeltaCar(ctx, &delta, src, nil, root))
+
+	data := delta.Bytes()
+	data[len(data)-2] ^= 0xff
+
+	dst := NewMemoryStorageWithOptions()
+	_, err := ApplyDeltaCar(ctx, bytes.NewReader(data), dst)
+	assert.ErrorAs(t, err, &ErrBlockCorrupted{})
+	assert.Equal(t, 0, dst.Len())
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+var ErrUnknownEncryptionKey = errors.New("Unknown encryption key id")
+var ErrInvalidEnvelope = errors.New("Invalid encrypted block envelope")
+
+const encryptedEnvelopeVersion = 1
+
+// KeyProvider hands out the keys used by the Encrypted storage
+// Keys are AES keys, so they should be 16, 24 or 32 bytes long
+type KeyProvider interface {
+	// CurrentKey returns the key id and key new blocks are encrypted with
+	CurrentKey() (string, []byte, error)
+	// Key returns the key for a key id previously returned by CurrentKey
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider backed by a fixed set of keys
+type StaticKeyProvider struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewStaticKeyProvider creates a KeyProvider encrypting with the key currentID
+// The other keys are still used to decrypt blocks written before a rotation
+func NewStaticKeyProvider(currentID string, keys map[string][]byte) *StaticKeyProvider {
+	return &StaticKeyProvider{currentID: currentID, keys: keys}
+}
+
+func (kp *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := kp.Key(kp.currentID)
+	return kp.currentID, key, err
+}
+
+func (kp *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, exists := kp.keys[id]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownEncryptionKey, id)
+	}
+	return key, nil
+}
+
+// Encrypted encrypts blocks with AES-GCM before writing them to another storage.
+// Blocks are still stored under their plaintext link, so links stay stable,
+// and the link is authenticated with the block so data can't be swapped
+// between links. Each block starts with a small envelope header:
+//
+//	version (1 byte) | key id length (1 byte) | key id | nonce | ciphertext
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewEncryptedStorage(redisStore, storage.NewStaticKeyProvider("k1", keys))
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Encrypted struct {
+	inner       Storage
+	keyProvider KeyProvider
+}
+
+// NewEncryptedStorage creates a storage encrypting blocks written to inner
+func NewEncryptedStorage(inner Storage, keyProvider KeyProvider) *Encrypted {
+	return &Encrypted{inner: inner, keyProvider: keyProvider}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (store *Encrypted) seal(lnk ipld.Link, plaintext []byte) ([]byte, error) {
+	keyID, key, err := store.keyProvider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("Encryption key id too long: %q", keyID)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, 2+len(keyID)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	envelope = append(envelope, encryptedEnvelopeVersion, byte(len(keyID)))
+	envelope = append(envelope, keyID...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope = append(envelope, nonce...)
+
+	return aead.Seal(envelope, nonce, plaintext, []byte(lnk.String())), nil
+}
+
+func (store *Encrypted) open(lnk ipld.Link, envelope []byte) ([]byte, error) {
+	if len(envelope) < 2 || envelope[0] != encryptedEnvelopeVersion {
+		return nil, ErrInvalidEnvelope
+	}
+
+	idEnd := 2 + int(envelope[1])
+	if len(envelope) < idEnd {
+		return nil, ErrInvalidEnvelope
+	}
+
+	key, err := store.keyProvider.Key(string(envelope[2:idEnd]))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceEnd := idEnd + aead.NonceSize()
+	if len(envelope) < nonceEnd {
+		return nil, ErrInvalidEnvelope
+	}
+
+	plaintext, err := aead.Open(nil, envelope[idEnd:nonceEnd], envelope[nonceEnd:], []byte(lnk.String()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	return plaintext, nil
+}
+
+// Reencrypt rewrites the block for lnk with the current key, used to rotate keys
+func (store *Encrypted) Reencrypt(lnkCtx ipld.LinkContext, lnk ipld.Link) error {
+	envelope, err := readBlock(store.inner, lnkCtx, lnk)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := store.open(lnk, envelope)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := store.seal(lnk, plaintext)
+	if err != nil {
+		return err
+	}
+
+	return writeBlock(store.inner, lnkCtx, lnk, sealed)
+}
+
+func (store *Encrypted) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	envelope, err := readBlock(store.inner, lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := store.open(lnk, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(plaintext), nil
+}
+
+func (store *Encrypted) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		sealed, err := store.seal(lnk, buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		return writeBlock(store.inner, lnkCtx, lnk, sealed)
+	}, nil
+}
+
+func (store *Encrypted) unwrap() []Storage {
+	return []Storage{store.inner}
+}
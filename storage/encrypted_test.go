@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageEncryptedRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	keys := map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}
+	store := NewEncryptedStorage(inner, NewStaticKeyProvider("k1", keys))
+
+	lnk := storeTestNode(t, store, "world")
+
+	// The plaintext never reaches the wrapped storage
+	raw, err := readBlock(inner, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	assert.False(bytes.Contains(raw, []byte("world")))
+
+	data, err := readBlock(store, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	assert.True(bytes.Contains(data, []byte("world")))
+
+	// Blocks are bound to their link
+	other := storeTestNode(t, NewMemoryStorage(), "other")
+	assert.Nil(writeBlock(inner, ipld.LinkContext{}, other, raw))
+	_, err = store.OpenRead(ipld.LinkContext{}, other)
+	assert.ErrorIs(err, ErrInvalidEnvelope)
+}
+
+func TestStorageEncryptedKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	keys := map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}
+
+	lnk := storeTestNode(t, NewEncryptedStorage(inner, NewStaticKeyProvider("k1", keys)), "world")
+
+	// Old blocks are still readable after rotating the current key
+	rotated := NewEncryptedStorage(inner, NewStaticKeyProvider("k2", keys))
+	_, err := rotated.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	// Until re-encrypted, the old key is still required
+	delete(keys, "k1")
+	_, err = rotated.OpenRead(ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, ErrUnknownEncryptionKey)
+
+	keys["k1"] = bytes.Repeat([]byte{1}, 32)
+	assert.Nil(rotated.Reencrypt(ipld.LinkContext{}, lnk))
+	delete(keys, "k1")
+
+	_, err = rotated.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+}
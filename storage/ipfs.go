@@ -2,14 +2,46 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
+	"github.com/ipfs/go-cid"
 	ipfsApi "github.com/ipfs/go-ipfs-api"
+	files "github.com/ipfs/go-ipfs-files"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
 )
 
+var ErrUnexpectedCID = errors.New("IPFS stored the block under an unexpected CID")
+
+// PinPolicy tells the IPFS storage which container roots to pin
+type PinPolicy int
+
+const (
+	// PinNone leaves pinning to the user, blocks may be garbage collected
+	PinNone PinPolicy = iota
+	// PinRoots pins every root built, superseded roots stay pinned
+	PinRoots
+	// PinLatestRoot pins every root built and unpins the root it supersedes
+	PinLatestRoot
+)
+
+// IPFSOption configures the IPFS storage
+type IPFSOption func(*IPFS)
+
+// WithPinPolicy sets which roots are pinned when containers are built
+func WithPinPolicy(policy PinPolicy) IPFSOption {
+	return func(store *IPFS) {
+		store.pinPolicy = policy
+	}
+}
+
 // IPFS structu contains the IPFS shell connection
 //
 // The OpenRead method conforms to ipld.BlockReadOpener,
@@ -20,13 +52,23 @@ import (
 //		lsys.StorageReadOpener = (&store).OpenRead
 //		lsys.StorageWriteOpener = (&store).OpenWrite
 type IPFS struct {
-	shell *ipfsApi.Shell
+	shell     *ipfsApi.Shell
+	pinPolicy PinPolicy
 }
 
 func NewIPFSStorage(shell *ipfsApi.Shell) Storage {
 	return &IPFS{shell: shell}
 }
 
+// NewIPFSStorageWithOptions creates an IPFS storage configured by the options
+func NewIPFSStorageWithOptions(shell *ipfsApi.Shell, options ...IPFSOption) *IPFS {
+	store := &IPFS{shell: shell}
+	for _, opt := range options {
+		opt(store)
+	}
+	return store
+}
+
 func (store *IPFS) beInitialized() {
 
 }
@@ -41,6 +83,10 @@ func (store *IPFS) OpenRead(_ ipld.LinkContext, lnk ipld.Link) (io.Reader, error
 
 	block, err := store.shell.BlockGet(theCid.String())
 	if err != nil {
+		// Offline nodes report missing blocks instead of looking for them
+		if strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "could not find") {
+			return nil, ErrDataNotFound
+		}
 		return nil, fmt.Errorf("error loading %v: %v", theCid.String(), err)
 	}
 
@@ -52,13 +98,109 @@ func (store *IPFS) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteComm
 
 	buf := bytes.Buffer{}
 	return &buf, func(lnk ipld.Link) error {
-		_, err := store.shell.BlockPut(
-			buf.Bytes(),
-			// TODO: How to pass those params?
-			"cbor",
-			"sha2-512",
-			64,
-		)
-		return err
+		theCid, ok := lnk.(cidlink.Link)
+		if !ok {
+			return fmt.Errorf("Attempted to store a non CID link: %v", lnk)
+		}
+
+		// The block should be hashed the same way the link was
+		prefix := theCid.Prefix()
+
+		format, ok := cid.CodecToStr[prefix.Codec]
+		if !ok {
+			return fmt.Errorf("Unsupported codec for IPFS block: %x", prefix.Codec)
+		}
+
+		mhType, ok := multihash.Codes[prefix.MhType]
+		if !ok {
+			return fmt.Errorf("Unsupported multihash for IPFS block: %x", prefix.MhType)
+		}
+
+		key, err := store.shell.BlockPut(buf.Bytes(), format, mhType, prefix.MhLength)
+		if err != nil {
+			return err
+		}
+
+		stored, err := cid.Decode(key)
+		if err != nil {
+			return err
+		}
+
+		if !stored.Equals(theCid.Cid) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedCID, theCid.Cid, stored)
+		}
+
+		return nil
 	}, nil
 }
+
+// PinRoot applies the pin policy for a new container root
+// superseded is the root the container had before, nil for new containers
+func (store *IPFS) PinRoot(ctx context.Context, root ipld.Link, superseded ipld.Link) error {
+	store.beInitialized()
+
+	if store.pinPolicy == PinNone {
+		return nil
+	}
+
+	if err := store.shell.Request("pin/add", root.String()).
+		Option("recursive", true).
+		Exec(ctx, nil); err != nil {
+		return err
+	}
+
+	if store.pinPolicy != PinLatestRoot || superseded == nil || superseded == root {
+		return nil
+	}
+
+	err := store.shell.Request("pin/rm", superseded.String()).
+		Option("recursive", true).
+		Exec(ctx, nil)
+
+	// Someone else may have unpinned it already
+	if err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return err
+	}
+
+	return nil
+}
+
+// PutMany imports all the blocks at once as a CAR file with dag/import
+func (store *IPFS) PutMany(ctx context.Context, blocks []Block) error {
+	store.beInitialized()
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	cids := make([]cid.Cid, 0, len(blocks))
+	for _, block := range blocks {
+		theCid, ok := block.Link.(cidlink.Link)
+		if !ok {
+			return fmt.Errorf("Attempted to store a non CID link: %v", block.Link)
+		}
+		cids = append(cids, theCid.Cid)
+	}
+
+	// A CAR needs at least one root, those shouldn't be pinned by the import
+	car := bytes.Buffer{}
+	if err := gocar.WriteHeader(&gocar.CarHeader{Roots: cids[:1], Version: 1}, &car); err != nil {
+		return err
+	}
+
+	for i, block := range blocks {
+		if err := carutil.LdWrite(&car, cids[i].Bytes(), block.Data); err != nil {
+			return err
+		}
+	}
+
+	fileReader := files.NewMultiFileReader(
+		files.NewSliceDirectory([]files.DirEntry{files.FileEntry("", files.NewReaderFile(&car))}),
+		true,
+	)
+
+	return store.shell.Request("dag/import").
+		Option("pin-roots", false).
+		Body(fileReader).
+		Exec(ctx, nil)
+}
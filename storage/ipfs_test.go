@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ipfsApi "github.com/ipfs/go-ipfs-api"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/ipfstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageIPFSWriteUsesLinkPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+	store := NewIPFSStorage(server.Shell())
+
+	lnk := storeTestNode(t, store, "world")
+	assert.True(server.Has(lnk.(cidlink.Link).Cid))
+
+	data, err := readBlock(store, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	assert.Nil(VerifyBlock(lnk, data))
+}
+
+func TestStorageIPFSWriteDetectsCIDMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+
+	// A node hashing blocks its own way
+	forcing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		query.Set("mhtype", "sha2-256")
+		query.Del("mhlen")
+		r.URL.RawQuery = query.Encode()
+		server.ServeHTTP(w, r)
+	}))
+	defer forcing.Close()
+
+	store := NewIPFSStorage(ipfsApi.NewShell(forcing.URL))
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+
+	err := writeBlock(store, ipld.LinkContext{}, lnk, mustReadBlock(t, memory, lnk))
+	assert.ErrorIs(err, ErrUnexpectedCID)
+}
+
+func TestStorageIPFSPinPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+	shell := server.Shell()
+
+	first := storeTestNode(t, NewIPFSStorage(shell), "first")
+	second := storeTestNode(t, NewIPFSStorage(shell), "second")
+	firstCid, secondCid := first.(cidlink.Link).Cid, second.(cidlink.Link).Cid
+
+	ctx := context.Background()
+
+	// Nothing is pinned by default
+	assert.Nil(NewIPFSStorageWithOptions(shell).PinRoot(ctx, first, nil))
+	assert.False(server.Pinned(firstCid))
+
+	// Superseded roots stay pinned
+	store := NewIPFSStorageWithOptions(shell, WithPinPolicy(PinRoots))
+	assert.Nil(store.PinRoot(ctx, first, nil))
+	assert.Nil(store.PinRoot(ctx, second, first))
+	assert.True(server.Pinned(firstCid))
+	assert.True(server.Pinned(secondCid))
+
+	// Only the latest root is kept pinned
+	store = NewIPFSStorageWithOptions(shell, WithPinPolicy(PinLatestRoot))
+	assert.Nil(store.PinRoot(ctx, first, second))
+	assert.True(server.Pinned(firstCid))
+	assert.False(server.Pinned(secondCid))
+
+	// Superseded roots not pinned anymore are fine
+	assert.Nil(store.PinRoot(ctx, first, second))
+}
+
+func TestStorageIPFSPutMany(t *testing.T) {
+	assert := assert.New(t)
+
+	server := ipfstest.NewServer()
+	defer server.Close()
+	store := NewIPFSStorage(server.Shell()).(*IPFS)
+
+	memory := NewMemoryStorage()
+	first := storeTestNode(t, memory, "first")
+	second := storeTestNode(t, memory, "second")
+
+	assert.Nil(store.PutMany(context.Background(), []Block{
+		{Link: first, Data: mustReadBlock(t, memory, first)},
+		{Link: second, Data: mustReadBlock(t, memory, second)},
+	}))
+	assert.Equal(2, server.Len())
+
+	// Imported roots aren't pinned
+	assert.False(server.Pinned(first.(cidlink.Link).Cid))
+
+	for _, lnk := range []ipld.Link{first, second} {
+		_, err := store.OpenRead(ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+	}
+
+	_, err := store.OpenRead(ipld.LinkContext{}, storeTestNode(t, memory, "missing"))
+	assert.ErrorIs(err, ErrDataNotFound)
+}
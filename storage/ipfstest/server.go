@@ -0,0 +1,290 @@
+// Package ipfstest provides an in-process fake of the IPFS HTTP API,
+// so code using the IPFS storage can be tested without an IPFS daemon.
+package ipfstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipfsApi "github.com/ipfs/go-ipfs-api"
+	gocar "github.com/ipld/go-car"
+	"github.com/multiformats/go-multihash"
+)
+
+// Server is an httptest server implementing the block/put, block/get,
+// block/stat, pin/add, pin/rm and dag/import commands of the IPFS HTTP API
+// over an in-memory blockstore. Blocks are indexed by multihash like IPFS
+// does, so they can be requested with any CID version or codec.
+//
+//	server := ipfstest.NewServer()
+//	defer server.Close()
+//	store := storage.NewIPFSStorage(server.Shell())
+type Server struct {
+	*httptest.Server
+
+	mutex  sync.RWMutex
+	blocks map[string][]byte
+	pins   map[string]bool
+}
+
+// NewServer starts a new fake IPFS node, it should be closed when done
+func NewServer() *Server {
+	server := &Server{
+		blocks: make(map[string][]byte),
+		pins:   make(map[string]bool),
+	}
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// Shell returns an IPFS shell connected to the server
+func (s *Server) Shell() *ipfsApi.Shell {
+	return ipfsApi.NewShell(s.URL)
+}
+
+// Has tells if the server holds the block
+func (s *Server) Has(c cid.Cid) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.blocks[string(c.Hash())]
+	return ok
+}
+
+// Pinned tells if the block is pinned
+func (s *Server) Pinned(c cid.Cid) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.pins[string(c.Hash())]
+}
+
+// Len returns how many blocks the server holds
+func (s *Server) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.blocks)
+}
+
+// ServeHTTP handles the IPFS HTTP API commands
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res interface{}
+	var err error
+
+	switch r.URL.Path {
+	case "/api/v0/block/put":
+		res, err = s.blockPut(r)
+	case "/api/v0/block/get":
+		var data []byte
+		if data, err = s.blockGet(r); err == nil {
+			w.Write(data)
+			return
+		}
+	case "/api/v0/block/stat":
+		res, err = s.blockStat(r)
+	case "/api/v0/pin/add":
+		res, err = s.pinAdd(r)
+	case "/api/v0/pin/rm":
+		res, err = s.pinRm(r)
+	case "/api/v0/dag/import":
+		res, err = s.dagImport(r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "404 page not found")
+		return
+	}
+
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Message": err.Error(),
+			"Code":    0,
+			"Type":    "error",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// argCid parses the CID given as the arg query param
+func argCid(r *http.Request) (cid.Cid, error) {
+	c, err := cid.Decode(r.URL.Query().Get("arg"))
+	if err != nil {
+		return cid.Cid{}, fmt.Errorf("invalid path %q: %v", r.URL.Query().Get("arg"), err)
+	}
+	return c, nil
+}
+
+// readFile returns the content of the first file sent as multipart body
+func readFile(r *http.Request) ([]byte, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(part)
+}
+
+func (s *Server) blockPut(r *http.Request) (interface{}, error) {
+	data, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+
+	if format := query.Get("format"); format != "" {
+		codec, ok := cid.Codecs[format]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized format: %s", format)
+		}
+		prefix.Codec = codec
+	}
+
+	if mhType := query.Get("mhtype"); mhType != "" {
+		code, ok := multihash.Names[mhType]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized multihash function: %s", mhType)
+		}
+		prefix.MhType = code
+	}
+
+	if mhLen := query.Get("mhlen"); mhLen != "" {
+		if prefix.MhLength, err = strconv.Atoi(mhLen); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := prefix.Sum(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.blocks[string(c.Hash())] = data
+	s.mutex.Unlock()
+
+	return map[string]interface{}{"Key": c.String(), "Size": len(data)}, nil
+}
+
+func (s *Server) block(r *http.Request) (cid.Cid, []byte, error) {
+	c, err := argCid(r)
+	if err != nil {
+		return cid.Cid{}, nil, err
+	}
+
+	s.mutex.RLock()
+	data, ok := s.blocks[string(c.Hash())]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return cid.Cid{}, nil, fmt.Errorf("block was not found locally (offline): ipld: could not find %s", c)
+	}
+
+	return c, data, nil
+}
+
+func (s *Server) blockGet(r *http.Request) ([]byte, error) {
+	_, data, err := s.block(r)
+	return data, err
+}
+
+func (s *Server) blockStat(r *http.Request) (interface{}, error) {
+	c, data, err := s.block(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"Key": c.String(), "Size": len(data)}, nil
+}
+
+func (s *Server) pinAdd(r *http.Request) (interface{}, error) {
+	c, _, err := s.block(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.pins[string(c.Hash())] = true
+	s.mutex.Unlock()
+
+	return map[string]interface{}{"Pins": []string{c.String()}}, nil
+}
+
+func (s *Server) pinRm(r *http.Request) (interface{}, error) {
+	c, err := argCid(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.pins[string(c.Hash())] {
+		return nil, fmt.Errorf("not pinned or pinned indirectly")
+	}
+	delete(s.pins, string(c.Hash()))
+
+	return map[string]interface{}{"Pins": []string{c.String()}}, nil
+}
+
+func (s *Server) dagImport(r *http.Request) (interface{}, error) {
+	data, err := readFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The CAR reader checks every block against its CID
+	cr, err := gocar.NewCarReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		block, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		s.blocks[string(block.Cid().Hash())] = block.RawData()
+	}
+
+	root := cr.Header.Roots[0]
+	pinErr := ""
+	if r.URL.Query().Get("pin-roots") != "false" {
+		for _, root := range cr.Header.Roots {
+			if _, ok := s.blocks[string(root.Hash())]; !ok {
+				pinErr = fmt.Sprintf("block was not found locally (offline): ipld: could not find %s", root)
+				continue
+			}
+			s.pins[string(root.Hash())] = true
+		}
+	}
+
+	return map[string]interface{}{
+		"Root": map[string]interface{}{
+			"Cid":         map[string]string{"/": root.String()},
+			"PinErrorMsg": pinErr,
+		},
+	}, nil
+}
@@ -1,10 +1,20 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
+	"context"
+	"fmt"
 	"io"
+	"sort"
+	"sync"
 
+	"github.com/ipfs/go-cid"
+	gocar "github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 )
 
 // Memory is a simple in-memory storage for data indexed by ipld.Link.
@@ -21,24 +31,97 @@ import (
 //
 // This storage is mostly expected to be used for testing and demos,
 // and as an example of how you can implement and integrate your own storage systems.
+//
+// It's safe for concurrent use, as long as the map isn't poked meanwhile.
+// Save and Load snapshot the blocks to disk as a CAR file, and
+// WithMaxBytes bounds the memory used by evicting the least recently used blocks.
 type Memory struct {
 	Bag map[ipld.Link][]byte
+
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[ipld.Link]*list.Element
+	lru      *list.List
+}
+
+// MemoryOption configures the Memory storage built by NewMemoryStorageWithOptions
+type MemoryOption func(*Memory)
+
+// WithMaxBytes keeps at most maxBytes of blocks, evicting the least recently used ones
+// Evicted blocks are gone for good, so it only fits data that can be rebuilt
+func WithMaxBytes(maxBytes int64) MemoryOption {
+	return func(m *Memory) {
+		m.maxBytes = maxBytes
+	}
 }
 
 func NewMemoryStorage() Storage {
 	return &Memory{}
 }
 
+// NewMemoryStorageWithOptions creates a Memory storage configured by the options
+func NewMemoryStorageWithOptions(options ...MemoryOption) *Memory {
+	store := &Memory{}
+	for _, opt := range options {
+		opt(store)
+	}
+	return store
+}
+
+// beInitialized must be called with the mutex held
 func (store *Memory) beInitialized() {
-	if store.Bag != nil {
+	if store.Bag == nil {
+		store.Bag = make(map[ipld.Link][]byte)
+	}
+	if store.lru == nil {
+		store.entries = make(map[ipld.Link]*list.Element)
+		store.lru = list.New()
+	}
+}
+
+// get must be called with the mutex held
+func (store *Memory) get(lnk ipld.Link) ([]byte, bool) {
+	data, exists := store.Bag[lnk]
+	if exists && store.maxBytes > 0 {
+		if elem, tracked := store.entries[lnk]; tracked {
+			store.lru.MoveToFront(elem)
+		}
+	}
+	return data, exists
+}
+
+// put must be called with the mutex held
+func (store *Memory) put(lnk ipld.Link, data []byte) {
+	store.Bag[lnk] = data
+	if store.maxBytes <= 0 {
+		return
+	}
+
+	if elem, exists := store.entries[lnk]; exists {
+		store.lru.MoveToFront(elem)
 		return
 	}
-	store.Bag = make(map[ipld.Link][]byte)
+
+	store.entries[lnk] = store.lru.PushFront(lnk)
+	store.size += int64(len(data))
+
+	// Evict the least recently used blocks until we fit again,
+	// the block just written is always kept
+	for store.size > store.maxBytes && store.lru.Len() > 1 {
+		oldest := store.lru.Remove(store.lru.Back()).(ipld.Link)
+		store.size -= int64(len(store.Bag[oldest]))
+		delete(store.entries, oldest)
+		delete(store.Bag, oldest)
+	}
 }
 
 func (store *Memory) OpenRead(_ ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
 	store.beInitialized()
-	data, exists := store.Bag[lnk]
+	data, exists := store.get(lnk)
 	if !exists {
 		return nil, ErrDataNotFound
 	}
@@ -46,10 +129,176 @@ func (store *Memory) OpenRead(_ ipld.LinkContext, lnk ipld.Link) (io.Reader, err
 }
 
 func (store *Memory) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
-	store.beInitialized()
 	buf := bytes.Buffer{}
 	return &buf, func(lnk ipld.Link) error {
-		store.Bag[lnk] = buf.Bytes()
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+
+		store.beInitialized()
+		store.put(lnk, buf.Bytes())
 		return nil
 	}, nil
 }
+
+// PutMany writes all the blocks into the map
+func (store *Memory) PutMany(_ context.Context, blocks []Block) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.beInitialized()
+	for _, block := range blocks {
+		store.put(block.Link, block.Data)
+	}
+	return nil
+}
+
+// GetMany returns all the blocks found in the map
+func (store *Memory) GetMany(_ context.Context, links []ipld.Link) ([]Block, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.beInitialized()
+	blocks := make([]Block, 0, len(links))
+	for _, lnk := range links {
+		if data, exists := store.get(lnk); exists {
+			blocks = append(blocks, Block{Link: lnk, Data: data})
+		}
+	}
+	return blocks, nil
+}
+
+// Has tells if the block is in the map, without making it recently used
+func (store *Memory) Has(_ context.Context, lnk ipld.Link) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, exists := store.Bag[lnk]
+	return exists, nil
+}
+
+// Delete removes the block from the map
+func (store *Memory) Delete(_ context.Context, lnk ipld.Link) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.beInitialized()
+	if elem, tracked := store.entries[lnk]; tracked {
+		store.lru.Remove(elem)
+		delete(store.entries, lnk)
+		store.size -= int64(len(store.Bag[lnk]))
+	}
+	delete(store.Bag, lnk)
+	return nil
+}
+
+// List calls fn with the link of every block, blocks added meanwhile may be left out
+func (store *Memory) List(ctx context.Context, fn func(lnk ipld.Link) error) error {
+	store.mutex.Lock()
+	links := make([]ipld.Link, 0, len(store.Bag))
+	for lnk := range store.Bag {
+		links = append(links, lnk)
+	}
+	store.mutex.Unlock()
+
+	for _, lnk := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(lnk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of blocks held
+func (store *Memory) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.Bag)
+}
+
+// Save writes every block as a CARv1 file declaring the given roots
+// Blocks are sorted by link, so the same blocks always give the same file
+func (store *Memory) Save(w io.Writer, roots ...ipld.Link) error {
+	rootCids := make([]cid.Cid, 0, len(roots))
+	for _, root := range roots {
+		rootCid, ok := root.(cidlink.Link)
+		if !ok {
+			return fmt.Errorf("Attempted to save a non CID root: %v", root)
+		}
+		rootCids = append(rootCids, rootCid.Cid)
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	links := make([]ipld.Link, 0, len(store.Bag))
+	for lnk := range store.Bag {
+		links = append(links, lnk)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].String() < links[j].String()
+	})
+
+	writer := bufio.NewWriter(w)
+	if err := gocar.WriteHeader(&gocar.CarHeader{Roots: rootCids, Version: 1}, writer); err != nil {
+		return err
+	}
+
+	for _, lnk := range links {
+		theCid, ok := lnk.(cidlink.Link)
+		if !ok {
+			return fmt.Errorf("Attempted to save a non CID link: %v", lnk)
+		}
+
+		if err := carutil.LdWrite(writer, theCid.Bytes(), store.Bag[lnk]); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// Load adds the blocks of a CARv1 file, like the ones written by Save, and returns its roots
+func (store *Memory) Load(r io.Reader) ([]ipld.Link, error) {
+	reader := bufio.NewReader(r)
+
+	header, err := gocar.ReadHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Version != 1 {
+		return nil, ErrInvalidCar
+	}
+
+	var blocks []Block
+	for {
+		section, err := carutil.LdRead(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		c, n, err := carutil.ReadCid(section)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, Block{Link: cidlink.Link{Cid: c}, Data: section[n:]})
+	}
+
+	if err := store.PutMany(context.Background(), blocks); err != nil {
+		return nil, err
+	}
+
+	roots := make([]ipld.Link, 0, len(header.Roots))
+	for _, root := range header.Roots {
+		roots = append(roots, cidlink.Link{Cid: root})
+	}
+
+	return roots, nil
+}
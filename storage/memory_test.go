@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"testing"
 
 	"github.com/ipfs/go-cid"
@@ -142,3 +144,100 @@ func TestStorageMemoryLoad(t *testing.T) {
 	)
 	assert.Nil(err)
 }
+
+func TestStorageMemorySaveLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemoryStorageWithOptions()
+	child := storeTestNode(t, store, "child")
+	root := storeTestLinkNode(t, store, "root", child)
+
+	snapshot := bytes.Buffer{}
+	assert.Nil(store.Save(&snapshot, root))
+
+	// Same blocks, same snapshot
+	again := bytes.Buffer{}
+	assert.Nil(store.Save(&again, root))
+	assert.Equal(snapshot.Bytes(), again.Bytes())
+
+	loaded := NewMemoryStorageWithOptions()
+	roots, err := loaded.Load(&snapshot)
+	assert.Nil(err)
+	assert.Equal([]ipld.Link{root}, roots)
+	assert.Equal(2, loaded.Len())
+	assert.Equal(mustReadBlock(t, store, child), mustReadBlock(t, loaded, child))
+	assert.Equal(mustReadBlock(t, store, root), mustReadBlock(t, loaded, root))
+
+	// Snapshots without roots load too
+	empty := bytes.Buffer{}
+	assert.Nil(store.Save(&empty))
+	roots, err = NewMemoryStorageWithOptions().Load(&empty)
+	assert.Nil(err)
+	assert.Empty(roots)
+
+	_, err = loaded.Load(bytes.NewReader([]byte("not a car")))
+	assert.NotNil(err)
+
+	// Only CID links can be saved
+	assert.NotNil(store.Save(&bytes.Buffer{}, namedLink("root")))
+}
+
+// namedLink is a link which isn't a CID
+type namedLink string
+
+func (namedLink) Prototype() ipld.LinkPrototype {
+	return nil
+}
+
+func (lnk namedLink) String() string {
+	return string(lnk)
+}
+
+func TestStorageMemoryMaxBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	// Blocks of same sized values are the same size
+	memory := NewMemoryStorage()
+	first := storeTestNode(t, memory, "first")
+	size := int64(len(mustReadBlock(t, memory, first)))
+
+	store := NewMemoryStorageWithOptions(WithMaxBytes(2 * size))
+	storeTestNode(t, store, "first")
+	second := storeTestNode(t, store, "secnd")
+
+	// Reading first makes second the least recently used
+	mustReadBlock(t, store, first)
+	third := storeTestNode(t, store, "third")
+
+	assert.Equal(2, store.Len())
+	_, err := store.OpenRead(ipld.LinkContext{}, second)
+	assert.ErrorIs(err, ErrDataNotFound)
+	mustReadBlock(t, store, first)
+	mustReadBlock(t, store, third)
+}
+
+func TestStorageMemoryHasListDelete(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store := NewMemoryStorageWithOptions(WithMaxBytes(1 << 20))
+	first := storeTestNode(t, store, "first")
+	second := storeTestNode(t, store, "second")
+
+	has, err := store.Has(ctx, first)
+	assert.Nil(err)
+	assert.True(has)
+
+	var listed []ipld.Link
+	assert.Nil(store.List(ctx, func(lnk ipld.Link) error {
+		listed = append(listed, lnk)
+		return nil
+	}))
+	assert.ElementsMatch([]ipld.Link{first, second}, listed)
+
+	assert.Nil(store.Delete(ctx, first))
+	has, err = store.Has(ctx, first)
+	assert.Nil(err)
+	assert.False(has)
+	assert.Equal(int64(len(mustReadBlock(t, store, second))), store.size)
+}
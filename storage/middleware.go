@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// Middleware wraps a storage to change how its blocks are read and written
+type Middleware func(Storage) Storage
+
+// Chain wraps inner with the middlewares, the first one being the outermost
+// so Chain(redisStore, Retry(3, 10*time.Millisecond), Timeout(time.Second))
+// retries reads and writes that timed out.
+//
+// Middlewares buffer whole blocks and hide the optional capabilities of
+// inner like BatchPutter, except Flusher, Prefetcher and RootPinner which
+// are passed through, when inner has them, so containers keep flushing and
+// pinning their roots.
+func Chain(inner Storage, middlewares ...Middleware) Storage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		inner = middlewares[i](inner)
+	}
+	return inner
+}
+
+// IsTransient tells if an operation failing with err may succeed when retried
+// Only timeouts, dropped or refused connections, Redis servers busy loading or
+// failing over and HTTP 5xx responses, from errors with a StatusCode() int
+// method, are transient. Anything else, like missing or corrupted blocks, is not.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		msg := redisErr.Error()
+		for _, prefix := range redisTransientErrors {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode() >= 500
+	}
+
+	return false
+}
+
+// Redis replies worth retrying, the server being busy or failing over
+var redisTransientErrors = []string{
+	"LOADING ", "READONLY ", "CLUSTERDOWN ", "TRYAGAIN ", "MASTERDOWN ", "BUSY ",
+	"ERR max number of clients reached",
+}
+
+// Retry retries the operations failing with transient errors, see IsTransient
+// Up to attempts tries are made, waiting backoff then doubling it between them
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return RetryIf(attempts, backoff, IsTransient)
+}
+
+// RetryIf is Retry with a custom check of which errors are transient
+func RetryIf(attempts int, backoff time.Duration, transient func(error) bool) Middleware {
+	return around(func(ctx context.Context, op opFunc) ([]byte, error) {
+		wait := backoff
+		for attempt := 1; ; attempt++ {
+			data, err := op(ctx)
+			if attempt >= attempts || !transient(err) || ctx.Err() != nil {
+				return data, err
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			wait *= 2
+		}
+	})
+}
+
+// Timeout fails the operations taking longer than timeout with context.DeadlineExceeded
+// The operation context is cancelled too, for storages honoring it
+func Timeout(timeout time.Duration) Middleware {
+	return around(func(ctx context.Context, op opFunc) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		// Storages ignoring the context are left behind, their result is dropped
+		type result struct {
+			data []byte
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			data, err := op(ctx)
+			done <- result{data, err}
+		}()
+
+		select {
+		case res := <-done:
+			return res.data, res.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+}
+
+// ConcurrencyLimit allows at most limit operations in flight on the storage
+func ConcurrencyLimit(limit int) Middleware {
+	slots := make(chan struct{}, limit)
+
+	return around(func(ctx context.Context, op opFunc) ([]byte, error) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-slots }()
+
+		return op(ctx)
+	})
+}
+
+// ReadOnly fails every write, and root pinning, with ErrReadOnlyStorage
+func ReadOnly() Middleware {
+	return func(inner Storage) Storage {
+		return expose(&readOnlyStorage{passThrough{inner}}, capabilitiesOf(inner)|exposeRootPinner)
+	}
+}
+
+// Capabilities of the wrapped storage exposed by middlewares
+const (
+	exposeFlusher = 1 << iota
+	exposePrefetcher
+	exposeRootPinner
+)
+
+func capabilitiesOf(inner Storage) int {
+	capabilities := 0
+	if _, ok := inner.(Flusher); ok {
+		capabilities |= exposeFlusher
+	}
+	if _, ok := inner.(Prefetcher); ok {
+		capabilities |= exposePrefetcher
+	}
+	if _, ok := inner.(RootPinner); ok {
+		capabilities |= exposeRootPinner
+	}
+	return capabilities
+}
+
+// middlewareStorage is a storage implementing every capability kept by middlewares
+type middlewareStorage interface {
+	Storage
+	Flusher
+	Prefetcher
+	RootPinner
+	wrapper
+}
+
+// expose returns the storage with only the given capabilities,
+// so checking for them tells what the wrapped storage can do
+func expose(store middlewareStorage, capabilities int) Storage {
+	switch capabilities {
+	case exposeFlusher:
+		return struct {
+			Storage
+			wrapper
+			Flusher
+		}{store, store, store}
+	case exposePrefetcher:
+		return struct {
+			Storage
+			wrapper
+			Prefetcher
+		}{store, store, store}
+	case exposeRootPinner:
+		return struct {
+			Storage
+			wrapper
+			RootPinner
+		}{store, store, store}
+	case exposeFlusher | exposePrefetcher:
+		return struct {
+			Storage
+			wrapper
+			Flusher
+			Prefetcher
+		}{store, store, store, store}
+	case exposeFlusher | exposeRootPinner:
+		return struct {
+			Storage
+			wrapper
+			Flusher
+			RootPinner
+		}{store, store, store, store}
+	case exposePrefetcher | exposeRootPinner:
+		return struct {
+			Storage
+			wrapper
+			Prefetcher
+			RootPinner
+		}{store, store, store, store}
+	case exposeFlusher | exposePrefetcher | exposeRootPinner:
+		return store
+	default:
+		return struct {
+			Storage
+			wrapper
+		}{store, store}
+	}
+}
+
+// passThrough forwards the capabilities kept by middlewares to the wrapped storage
+type passThrough struct {
+	inner Storage
+}
+
+func (p passThrough) unwrap() []Storage {
+	return []Storage{p.inner}
+}
+
+func (p passThrough) Flush(ctx context.Context) error {
+	return Flush(ctx, p.inner)
+}
+
+func (p passThrough) Prefetch(ctx context.Context, links []ipld.Link) error {
+	return p.inner.(Prefetcher).Prefetch(ctx, links)
+}
+
+func (p passThrough) PinRoot(ctx context.Context, root ipld.Link, superseded ipld.Link) error {
+	return p.inner.(RootPinner).PinRoot(ctx, root, superseded)
+}
+
+// opFunc runs a storage operation with the given context, returning the block read if any
+type opFunc func(ctx context.Context) ([]byte, error)
+
+// aroundFunc runs a storage operation, it must be called with the context to use
+type aroundFunc func(ctx context.Context, op opFunc) ([]byte, error)
+
+// around builds a middleware running every read and write of the storage through fn
+func around(fn aroundFunc) Middleware {
+	return func(inner Storage) Storage {
+		return expose(&aroundStorage{passThrough{inner}, fn}, capabilitiesOf(inner))
+	}
+}
+
+type aroundStorage struct {
+	passThrough
+	fn aroundFunc
+}
+
+func (store *aroundStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	// Every attempt reads its own block, only the one returned by fn is used
+	data, err := store.fn(contextOf(lnkCtx), func(ctx context.Context) ([]byte, error) {
+		opCtx := lnkCtx
+		opCtx.Ctx = ctx
+		return readBlock(store.inner, opCtx, lnk)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func (store *aroundStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		_, err := store.fn(contextOf(lnkCtx), func(ctx context.Context) ([]byte, error) {
+			opCtx := lnkCtx
+			opCtx.Ctx = ctx
+			return nil, writeBlock(store.inner, opCtx, lnk, buf.Bytes())
+		})
+		return err
+	}, nil
+}
+
+type readOnlyStorage struct {
+	passThrough
+}
+
+func (store *readOnlyStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	return store.inner.OpenRead(lnkCtx, lnk)
+}
+
+func (store *readOnlyStorage) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return nil, nil, ErrReadOnlyStorage
+}
+
+func (store *readOnlyStorage) PinRoot(_ context.Context, _ ipld.Link, _ ipld.Link) error {
+	return ErrReadOnlyStorage
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+// errTestConnRefused is a transient failure of the backend
+var errTestConnRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errTestBackendDown}
+
+// flakyStorage fails the first reads and writes before reaching its inner storage
+// They fail with errTestConnRefused, unless err is set
+type flakyStorage struct {
+	inner    Storage
+	failures int32
+	calls    int32
+	err      error
+}
+
+func (store *flakyStorage) fail() error {
+	if atomic.AddInt32(&store.calls, 1) > store.failures {
+		return nil
+	}
+	if store.err != nil {
+		return store.err
+	}
+	return errTestConnRefused
+}
+
+func (store *flakyStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	if err := store.fail(); err != nil {
+		return nil, err
+	}
+	return store.inner.OpenRead(lnkCtx, lnk)
+}
+
+func (store *flakyStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	if err := store.fail(); err != nil {
+		return nil, nil, err
+	}
+	return store.inner.OpenWrite(lnkCtx)
+}
+
+// slowStorage waits before every read, tracking how many are in flight
+type slowStorage struct {
+	inner    Storage
+	delay    time.Duration
+	inFlight int32
+	maxSeen  int32
+}
+
+func (store *slowStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	inFlight := atomic.AddInt32(&store.inFlight, 1)
+	defer atomic.AddInt32(&store.inFlight, -1)
+
+	for {
+		seen := atomic.LoadInt32(&store.maxSeen)
+		if inFlight <= seen || atomic.CompareAndSwapInt32(&store.maxSeen, seen, inFlight) {
+			break
+		}
+	}
+
+	time.Sleep(store.delay)
+	return store.inner.OpenRead(lnkCtx, lnk)
+}
+
+func (store *slowStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return store.inner.OpenWrite(lnkCtx)
+}
+
+func TestStorageMiddlewareRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+
+	flaky := &flakyStorage{inner: memory, failures: 2}
+	store := Chain(flaky, Retry(3, time.Millisecond))
+
+	assert.Equal(mustReadBlock(t, memory, lnk), mustReadBlock(t, store, lnk))
+	assert.Equal(int32(3), flaky.calls)
+
+	// Writes are retried as well
+	flaky = &flakyStorage{inner: NewMemoryStorage(), failures: 1}
+	storeTestNode(t, Chain(flaky, Retry(2, time.Millisecond)), "world")
+	assert.Equal(int32(2), flaky.calls)
+
+	// Gives up after the last attempt
+	flaky = &flakyStorage{inner: memory, failures: 5}
+	_, err := readBlock(Chain(flaky, Retry(3, time.Millisecond)), ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, errTestBackendDown)
+	assert.Equal(int32(3), flaky.calls)
+
+	// Missing blocks aren't worth retrying
+	flaky = &flakyStorage{inner: NewMemoryStorage()}
+	_, err = readBlock(Chain(flaky, Retry(3, time.Millisecond)), ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, ErrDataNotFound)
+	assert.Equal(int32(1), flaky.calls)
+
+	// Nor are permanent failures
+	flaky = &flakyStorage{inner: memory, failures: 5, err: errors.New("cbor: unexpected end of input")}
+	_, err = readBlock(Chain(flaky, Retry(3, time.Millisecond)), ipld.LinkContext{}, lnk)
+	assert.NotNil(err)
+	assert.Equal(int32(1), flaky.calls)
+
+	// Nor are cancelled operations
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky = &flakyStorage{inner: memory, failures: 5}
+	_, err = readBlock(Chain(flaky, Retry(3, time.Hour)), ipld.LinkContext{Ctx: ctx}, lnk)
+	assert.ErrorIs(err, errTestBackendDown)
+	assert.Equal(int32(1), flaky.calls)
+}
+
+// statusError is an HTTP failure
+type statusError int
+
+func (err statusError) Error() string {
+	return http.StatusText(int(err))
+}
+
+func (err statusError) StatusCode() int {
+	return int(err)
+}
+
+// redisReply is an error replied by a Redis server
+type redisReply string
+
+func (err redisReply) Error() string {
+	return string(err)
+}
+
+func (redisReply) RedisError() {}
+
+func TestStorageIsTransient(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, err := range []error{
+		context.DeadlineExceeded,
+		errTestConnRefused,
+		fmt.Errorf("get: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true}),
+		io.ErrUnexpectedEOF,
+		redisReply("LOADING Redis is loading the dataset in memory"),
+		redisReply("CLUSTERDOWN The cluster is down"),
+		statusError(http.StatusServiceUnavailable),
+	} {
+		assert.True(IsTransient(err), "%v", err)
+	}
+
+	for _, err := range []error{
+		nil,
+		context.Canceled,
+		ErrDataNotFound,
+		ErrReadOnlyStorage,
+		ErrBlockCorrupted{},
+		errTestBackendDown,
+		fmt.Errorf("%w: 1 of 2 backends", ErrWriteQuorumNotReached),
+		&net.DNSError{Err: "no such host", IsNotFound: true},
+		redisReply("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		statusError(http.StatusBadRequest),
+	} {
+		assert.False(IsTransient(err), "%v", err)
+	}
+}
+
+func TestStorageMiddlewareTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+
+	slow := &slowStorage{inner: memory, delay: 100 * time.Millisecond}
+	_, err := readBlock(Chain(slow, Timeout(5*time.Millisecond)), ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// Every attempt gets its own timeout
+	flaky := &flakyStorage{inner: &slowStorage{inner: memory, delay: time.Millisecond}, failures: 1}
+	store := Chain(flaky, Retry(2, time.Millisecond), Timeout(time.Second))
+	assert.Equal(mustReadBlock(t, memory, lnk), mustReadBlock(t, store, lnk))
+}
+
+// stallOnceStorage makes the first read wait, the next ones aren't delayed
+type stallOnceStorage struct {
+	Storage
+	delay time.Duration
+	reads int32
+}
+
+func (store *stallOnceStorage) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	if atomic.AddInt32(&store.reads, 1) == 1 {
+		time.Sleep(store.delay)
+	}
+	return store.Storage.OpenRead(lnkCtx, lnk)
+}
+
+func TestStorageMiddlewareTimeoutAbandonedAttempt(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+	expected := mustReadBlock(t, memory, lnk)
+
+	// The first attempt finishes while the retry's block is being used
+	stalling := &stallOnceStorage{Storage: memory, delay: 20 * time.Millisecond}
+	store := Chain(stalling, Retry(2, 0), Timeout(5*time.Millisecond))
+
+	reader, err := store.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	time.Sleep(40 * time.Millisecond)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(err)
+	assert.Equal(expected, data)
+}
+
+func TestStorageMiddlewareConcurrencyLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+
+	slow := &slowStorage{inner: memory, delay: 5 * time.Millisecond}
+	store := Chain(slow, ConcurrencyLimit(2))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := readBlock(store, ipld.LinkContext{}, lnk)
+			assert.Nil(err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int32(2), slow.maxSeen)
+}
+
+func TestStorageMiddlewareReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	lnk := storeTestNode(t, memory, "world")
+
+	store := Chain(memory, ReadOnly())
+	mustReadBlock(t, store, lnk)
+
+	_, _, err := store.OpenWrite(ipld.LinkContext{})
+	assert.ErrorIs(err, ErrReadOnlyStorage)
+
+	err = putMany(context.Background(), store, []Block{{Link: lnk, Data: []byte("data")}})
+	assert.ErrorIs(err, ErrReadOnlyStorage)
+
+	err = store.(RootPinner).PinRoot(context.Background(), lnk, nil)
+	assert.ErrorIs(err, ErrReadOnlyStorage)
+}
+
+func TestStorageMiddlewarePassThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	memory := NewMemoryStorage()
+	batching := NewBatchingStorage(memory)
+	store := Chain(batching, Retry(2, time.Millisecond), ConcurrencyLimit(4))
+
+	lnk := storeTestNode(t, store, "world")
+	assert.Equal(1, batching.Pending())
+
+	assert.Nil(store.(Flusher).Flush(context.Background()))
+	assert.Equal(0, batching.Pending())
+	mustReadBlock(t, memory, lnk)
+
+	// Only the capabilities of the wrapped storage are exposed
+	store = Chain(memory, Retry(2, time.Millisecond), Timeout(time.Second))
+	_, isFlusher := store.(Flusher)
+	_, isPrefetcher := store.(Prefetcher)
+	_, isPinner := store.(RootPinner)
+	assert.False(isFlusher || isPrefetcher || isPinner)
+
+	store = Chain(NewCachedStorage(memory, 1<<20), ReadOnly())
+	_, isFlusher = store.(Flusher)
+	_, isPrefetcher = store.(Prefetcher)
+	assert.False(isFlusher)
+	assert.True(isPrefetcher)
+}
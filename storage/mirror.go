@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+var ErrWriteQuorumNotReached = errors.New("Write quorum not reached on mirrored storage")
+
+// Mirror replicates every block to all of its backends.
+// Writes succeed once the write quorum is reached (all backends by default),
+// reads are served by the first backend having the block, optionally
+// repairing the backends that missed it.
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewMirrorStorage(redisStore, fileStore).WithWriteQuorum(1).WithReadRepair()
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Mirror struct {
+	backends    []Storage
+	writeQuorum int
+	readRepair  bool
+}
+
+// NewMirrorStorage creates a storage mirroring the primary into the replicas
+func NewMirrorStorage(primary Storage, replicas ...Storage) *Mirror {
+	backends := append([]Storage{primary}, replicas...)
+	return &Mirror{
+		backends:    backends,
+		writeQuorum: len(backends),
+	}
+}
+
+// WithWriteQuorum sets how many backends must accept a block for the write to succeed
+func (store *Mirror) WithWriteQuorum(quorum int) *Mirror {
+	if quorum < 1 {
+		quorum = 1
+	}
+	if quorum > len(store.backends) {
+		quorum = len(store.backends)
+	}
+	store.writeQuorum = quorum
+	return store
+}
+
+// WithReadRepair copies blocks found on a backend to the previous backends missing it
+func (store *Mirror) WithReadRepair() *Mirror {
+	store.readRepair = true
+	return store
+}
+
+// Backends returns the primary followed by the replicas
+func (store *Mirror) Backends() []Storage {
+	return store.backends
+}
+
+func (store *Mirror) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	var missing []Storage
+	var firstErr error
+
+	for _, backend := range store.backends {
+		data, err := readBlock(backend, lnkCtx, lnk)
+		if err == nil {
+			if store.readRepair {
+				// Best effort, the block is still served if repairing fails
+				for _, target := range missing {
+					_ = writeBlock(target, lnkCtx, lnk, data)
+				}
+			}
+
+			return bytes.NewReader(data), nil
+		}
+
+		if errors.Is(err, ErrDataNotFound) {
+			missing = append(missing, backend)
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return nil, ErrDataNotFound
+}
+
+func (store *Mirror) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		errs := make([]error, len(store.backends))
+
+		var wg sync.WaitGroup
+		for i, backend := range store.backends {
+			wg.Add(1)
+			go func(i int, backend Storage) {
+				defer wg.Done()
+				errs[i] = writeBlock(backend, lnkCtx, lnk, buf.Bytes())
+			}(i, backend)
+		}
+		wg.Wait()
+
+		written := 0
+		var firstErr error
+		for _, err := range errs {
+			if err == nil {
+				written++
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if written < store.writeQuorum {
+			return fmt.Errorf("%w: %d of %d written: %v", ErrWriteQuorumNotReached, written, store.writeQuorum, firstErr)
+		}
+
+		return nil
+	}, nil
+}
+
+func (store *Mirror) unwrap() []Storage {
+	return store.backends
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+var errTestBackendDown = errors.New("backend down")
+
+// failingStorage fails every read and write
+type failingStorage struct{}
+
+func (failingStorage) OpenRead(_ ipld.LinkContext, _ ipld.Link) (io.Reader, error) {
+	return nil, errTestBackendDown
+}
+
+func (failingStorage) OpenWrite(_ ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return nil, nil, errTestBackendDown
+}
+
+func TestStorageMirrorWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := NewMemoryStorage()
+	replica := NewMemoryStorage()
+	store := NewMirrorStorage(primary, replica)
+
+	lnk := storeTestNode(t, store, "world")
+
+	for _, backend := range store.Backends() {
+		_, err := backend.OpenRead(ipld.LinkContext{}, lnk)
+		assert.Nil(err)
+	}
+}
+
+func TestStorageMirrorWriteQuorum(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := NewMemoryStorage()
+	store := NewMirrorStorage(primary, failingStorage{})
+
+	// All backends are required by default
+	writer, commit, err := store.OpenWrite(ipld.LinkContext{})
+	assert.Nil(err)
+	_, err = writer.Write([]byte("data"))
+	assert.Nil(err)
+	err = commit(storeTestNode(t, NewMemoryStorage(), "world"))
+	assert.ErrorIs(err, ErrWriteQuorumNotReached)
+
+	// A single backend is enough now
+	store.WithWriteQuorum(1)
+	lnk := storeTestNode(t, store, "world")
+
+	_, err = primary.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	// Reads skip the failing backend
+	_, err = NewMirrorStorage(failingStorage{}, primary).OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+}
+
+func TestStorageMirrorReadRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := NewMemoryStorage()
+	replica := NewMemoryStorage()
+
+	// Only the replica has the block
+	lnk := storeTestNode(t, replica, "world")
+
+	_, err := NewMirrorStorage(primary, replica).OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	_, err = primary.OpenRead(ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, ErrDataNotFound)
+
+	_, err = NewMirrorStorage(primary, replica).WithReadRepair().OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	_, err = primary.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	// Missing on every backend
+	_, err = NewMirrorStorage(primary, replica).OpenRead(ipld.LinkContext{}, storeTestNode(t, NewMemoryStorage(), "other"))
+	assert.ErrorIs(err, ErrDataNotFound)
+}
@@ -2,13 +2,77 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 )
 
+var ErrRefCountingDisabled = errors.New("Reference counting is not enabled on the Redis storage")
+
+// Stores the block unless retained, then the TTL isn't applied
+var redisSetScript = redis.NewScript(`
+local refs = tonumber(redis.call('GET', KEYS[2]) or '0')
+local ttl = tonumber(ARGV[2])
+if refs > 0 or ttl <= 0 then
+	redis.call('SET', KEYS[1], ARGV[1])
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+end
+return refs
+`)
+
+// Counts new references to the block, retained blocks never expire
+var redisRetainScript = redis.NewScript(`
+local refs = redis.call('INCRBY', KEYS[2], ARGV[1])
+redis.call('PERSIST', KEYS[1])
+return refs
+`)
+
+// Drops a reference to the block, unreferenced blocks expire after the TTL or go away
+// Blocks never retained are left as they are
+var redisReleaseScript = redis.NewScript(`
+local refs = tonumber(redis.call('GET', KEYS[2]) or '0')
+if refs <= 0 then
+	return 0
+end
+refs = redis.call('DECR', KEYS[2])
+if refs <= 0 then
+	redis.call('DEL', KEYS[2])
+	local ttl = tonumber(ARGV[1])
+	if ttl > 0 then
+		redis.call('PEXPIRE', KEYS[1], ttl)
+	else
+		redis.call('DEL', KEYS[1])
+	end
+end
+return refs
+`)
+
+// Prefixes the raw values, base64 values written by older versions never start with it
+const redisRawValuePrefix = 0x00
+
+// Escapes the glob characters of the key prefix in SCAN patterns
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+type redisTTLKey struct{}
+
+// ContextWithTTL sets the TTL of the blocks written with the context,
+// overriding the one of the Redis storage, zero meaning no expiration
+//
+//	lsys.Store(ipld.LinkContext{Ctx: storage.ContextWithTTL(ctx, time.Hour)}, lp, node)
+func ContextWithTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, redisTTLKey{}, ttl)
+}
+
 // Redis is a key value storage for data indexed by ipld.Link.
 //
 // The OpenRead method conforms to ipld.BlockReadOpener,
@@ -18,44 +82,275 @@ import (
 //		store := storage.Redis{}
 //		lsys.StorageReadOpener = (&store).OpenRead
 //		lsys.StorageWriteOpener = (&store).OpenWrite
+//
+// Use NewRedisStorageWithOptions for authenticated, TLS, Sentinel or Cluster deployments.
+//
+// Blocks never expire unless a TTL is set with WithTTL or ContextWithTTL.
+// With WithRefCounting, Retain and Release keep a reference count of the
+// roots reaching each block in a side key, so blocks reachable from a
+// retained root are kept while the others expire.
 type Redis struct {
-	addr   string
-	passwd string
-	rdb    *redis.Client
+	addr      string
+	passwd    string
+	options   *redis.Options
+	keyPrefix string
+	base64    bool
+	ttl       time.Duration
+	refCount  bool
+	initOnce  sync.Once
+	rdb       redis.UniversalClient
+	// The client was created by the storage, not given with WithRedisClient
+	ownsClient bool
 }
 
+// RedisOption configures the Redis storage built by NewRedisStorageWithOptions
+type RedisOption func(*Redis) error
+
 func NewRedisStorage(addr, passwd string) Storage {
-	return &Redis{addr, passwd, nil}
+	return &Redis{addr: addr, passwd: passwd}
+}
+
+// NewRedisStorageWithOptions creates a Redis storage configured by the options
+// Without WithRedisOptions, WithRedisURL or WithRedisClient it connects to localhost:6379
+func NewRedisStorageWithOptions(options ...RedisOption) (*Redis, error) {
+	store := &Redis{addr: "localhost:6379"}
+	for _, opt := range options {
+		if err := opt(store); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// WithRedisOptions sets the options used to create the client, including password, DB and TLS
+func WithRedisOptions(options *redis.Options) RedisOption {
+	return func(r *Redis) error {
+		r.options = options
+		return nil
+	}
+}
+
+// WithRedisURL sets the client options from a redis:// or rediss:// URL
+func WithRedisURL(url string) RedisOption {
+	return func(r *Redis) error {
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			return err
+		}
+		r.options = options
+		return nil
+	}
+}
+
+// WithRedisClient uses an existing client, e.g. a Sentinel or Cluster one
+func WithRedisClient(client redis.UniversalClient) RedisOption {
+	return func(r *Redis) error {
+		r.rdb = client
+		return nil
+	}
+}
+
+// WithKeyPrefix prefixes every key, so many tenants can share the same Redis
+// On Cluster deployments, braces in the prefix must make a hash tag like {tenant}:
+func WithKeyPrefix(prefix string) RedisOption {
+	return func(r *Redis) error {
+		r.keyPrefix = prefix
+		return nil
+	}
+}
+
+// WithBase64Values keeps writing base64 encoded values, as older versions did
+// Both encodings are always readable, this only matters for older readers
+func WithBase64Values() RedisOption {
+	return func(r *Redis) error {
+		r.base64 = true
+		return nil
+	}
+}
+
+// WithTTL sets the expiration of every block written, zero meaning no expiration
+func WithTTL(ttl time.Duration) RedisOption {
+	return func(r *Redis) error {
+		r.ttl = ttl
+		return nil
+	}
+}
+
+// WithRefCounting enables Retain and Release of roots
+// Blocks retained by a root are never expired by their TTL
+func WithRefCounting() RedisOption {
+	return func(r *Redis) error {
+		r.refCount = true
+		return nil
+	}
 }
 
 func (store *Redis) beInitialized() {
-	if store.rdb != nil {
-		return
+	store.initOnce.Do(func() {
+		if store.rdb != nil {
+			return
+		}
+
+		options := store.options
+		if options == nil {
+			options = &redis.Options{
+				Addr:     store.addr,
+				Password: store.passwd,
+			}
+		}
+
+		store.rdb = redis.NewClient(options)
+		store.ownsClient = true
+	})
+}
+
+// Close closes the client created by the storage
+// Clients given with WithRedisClient are left to their owner
+func (store *Redis) Close() error {
+	store.beInitialized()
+
+	if !store.ownsClient {
+		return nil
+	}
+	return store.rdb.Close()
+}
+
+// key returns the Redis key used for the link
+func (store *Redis) key(lnk ipld.Link) string {
+	return store.keyPrefix + lnk.String()
+}
+
+// refsKey returns the Redis key counting the references to the link
+// It hashes to the same Cluster slot as the block key, as scripts use both
+func (store *Redis) refsKey(lnk ipld.Link) string {
+	key := store.key(lnk)
+	if redisHashTagged(key) {
+		return key + ":refs"
+	}
+	return "{" + key + "}:refs"
+}
+
+// redisHashTagged tells if only part of the key, between braces, picks its Cluster slot
+func redisHashTagged(key string) bool {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return false
+	}
+	return strings.IndexByte(key[start+1:], '}') > 0
+}
+
+// writeTTL returns the TTL of the blocks written with the context
+func (store *Redis) writeTTL(ctx context.Context) time.Duration {
+	if ttl, ok := ctx.Value(redisTTLKey{}).(time.Duration); ok {
+		return ttl
+	}
+	return store.ttl
+}
+
+// set queues the write of the block data on the client or pipeline
+func (store *Redis) set(ctx context.Context, cmdable redis.Cmdable, lnk ipld.Link, data []byte) error {
+	ttl := store.writeTTL(ctx)
+
+	if !store.refCount {
+		return cmdable.Set(ctx, store.key(lnk), store.encode(data), ttl).Err()
+	}
+
+	keys := []string{store.key(lnk), store.refsKey(lnk)}
+	return redisSetScript.Eval(ctx, cmdable, keys, store.encode(data), ttl.Milliseconds()).Err()
+}
+
+// Retain adds a reference to every block reachable from root
+// Retained blocks are kept until every root retaining them is released
+func (store *Redis) Retain(ctx context.Context, root ipld.Link) error {
+	if !store.refCount {
+		return ErrRefCountingDisabled
+	}
+
+	store.beInitialized()
+
+	return Walk(ctx, store, root, func(lnk ipld.Link, _ []byte) (bool, error) {
+		keys := []string{store.key(lnk), store.refsKey(lnk)}
+		return true, redisRetainScript.Run(ctx, store.rdb, keys, 1).Err()
+	})
+}
+
+// Release drops a reference to every block reachable from root
+// Blocks without references left expire after the storage TTL, or are deleted without one
+func (store *Redis) Release(ctx context.Context, root ipld.Link) error {
+	if !store.refCount {
+		return ErrRefCountingDisabled
 	}
 
-	store.rdb = redis.NewClient(&redis.Options{
-		Addr:     store.addr,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+	store.beInitialized()
+
+	return Walk(ctx, store, root, func(lnk ipld.Link, _ []byte) (bool, error) {
+		keys := []string{store.key(lnk), store.refsKey(lnk)}
+		return true, redisReleaseScript.Run(ctx, store.rdb, keys, store.ttl.Milliseconds()).Err()
 	})
 }
 
-func (store *Redis) OpenRead(lnkContext ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+// refs returns the number of references to the block, zero without reference counting
+func (store *Redis) refs(ctx context.Context, lnk ipld.Link) (int64, error) {
+	if !store.refCount {
+		return 0, nil
+	}
+
 	store.beInitialized()
 
-	result, err := store.rdb.Get(lnkContext.Ctx, lnk.String()).Result()
+	refs, err := store.rdb.Get(ctx, store.refsKey(lnk)).Int64()
 	if err == redis.Nil {
-		return nil, ErrDataNotFound
-	} else if err != nil {
-		return nil, err
+		return 0, nil
+	}
+	return refs, err
+}
+
+// addRefs adds references to the block, so it never expires
+// It's meant to be called before the block is written, the write then keeps no TTL
+func (store *Redis) addRefs(ctx context.Context, lnk ipld.Link, refs int64) error {
+	if !store.refCount {
+		return ErrRefCountingDisabled
+	}
+
+	store.beInitialized()
+
+	keys := []string{store.key(lnk), store.refsKey(lnk)}
+	return redisRetainScript.Run(ctx, store.rdb, keys, refs).Err()
+}
+
+// encode returns the value stored for the block data
+func (store *Redis) encode(data []byte) interface{} {
+	if store.base64 {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return append([]byte{redisRawValuePrefix}, data...)
+}
+
+// decode returns the block data from a stored value
+// Values without the raw prefix are base64, as written by older versions
+func (store *Redis) decode(value []byte) []byte {
+	if len(value) > 0 && value[0] == redisRawValuePrefix {
+		return value[1:]
 	}
 
-	data, err := base64.StdEncoding.DecodeString(result)
+	decoded, err := base64.StdEncoding.DecodeString(string(value))
 	if err != nil {
+		// Let the link system report the mismatch
+		return value
+	}
+	return decoded
+}
+
+func (store *Redis) OpenRead(lnkContext ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	store.beInitialized()
+
+	result, err := store.rdb.Get(contextOf(lnkContext), store.key(lnk)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrDataNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
-	return bytes.NewReader(data), nil
+	return bytes.NewReader(store.decode(result)), nil
 }
 
 func (store *Redis) OpenWrite(lnkContext ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
@@ -63,12 +358,111 @@ func (store *Redis) OpenWrite(lnkContext ipld.LinkContext) (io.Writer, ipld.Bloc
 
 	buf := bytes.Buffer{}
 	return &buf, func(lnk ipld.Link) error {
-		result := base64.StdEncoding.EncodeToString(buf.Bytes())
-		err := store.rdb.Set(lnkContext.Ctx, lnk.String(), result, 0).Err()
+		return store.set(contextOf(lnkContext), store.rdb, lnk, buf.Bytes())
+	}, nil
+}
+
+// PutMany writes all the blocks using a single pipeline
+func (store *Redis) PutMany(ctx context.Context, blocks []Block) error {
+	store.beInitialized()
+
+	_, err := store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, block := range blocks {
+			if err := store.set(ctx, pipe, block.Link, block.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Has tells if the block exists, without reading it
+func (store *Redis) Has(ctx context.Context, lnk ipld.Link) (bool, error) {
+	store.beInitialized()
+
+	count, err := store.rdb.Exists(ctx, store.key(lnk)).Result()
+	return count > 0, err
+}
+
+// Delete removes the block, and its reference count
+// Both keys are in the same Cluster slot, see refsKey
+func (store *Redis) Delete(ctx context.Context, lnk ipld.Link) error {
+	store.beInitialized()
+
+	return store.rdb.Del(ctx, store.key(lnk), store.refsKey(lnk)).Err()
+}
+
+// List scans the keys under the storage prefix and calls fn with the link of every block
+// Keys which aren't CIDs are skipped, so other data can live under the same prefix
+// Every master of a Cluster is scanned, fn is never called concurrently
+func (store *Redis) List(ctx context.Context, fn func(lnk ipld.Link) error) error {
+	store.beInitialized()
+
+	cluster, ok := store.rdb.(*redis.ClusterClient)
+	if !ok {
+		return store.scan(ctx, store.rdb, fn)
+	}
+
+	var mutex sync.Mutex
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		return store.scan(ctx, client, func(lnk ipld.Link) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return fn(lnk)
+		})
+	})
+}
+
+// scan lists the blocks of a single Redis node
+func (store *Redis) scan(ctx context.Context, client redis.Cmdable, fn func(lnk ipld.Link) error) error {
+	iter := client.Scan(ctx, 0, redisGlobEscaper.Replace(store.keyPrefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), store.keyPrefix)
+		if strings.HasSuffix(key, ":refs") {
+			continue
+		}
+
+		c, err := cid.Decode(key)
 		if err != nil {
+			continue
+		}
+
+		if err := fn(cidlink.Link{Cid: c}); err != nil {
 			return err
 		}
+	}
 
+	return iter.Err()
+}
+
+// GetMany reads all the blocks using a single pipeline, missing blocks are left out
+func (store *Redis) GetMany(ctx context.Context, links []ipld.Link) ([]Block, error) {
+	store.beInitialized()
+
+	cmds := make([]*redis.StringCmd, len(links))
+	_, err := store.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, lnk := range links {
+			cmds[i] = pipe.Get(ctx, store.key(lnk))
+		}
 		return nil
-	}, nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	blocks := make([]Block, 0, len(links))
+	for i, cmd := range cmds {
+		value, err := cmd.Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, Block{Link: links[i], Data: store.decode(value)})
+	}
+
+	return blocks, nil
 }
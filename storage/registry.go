@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ipfsApi "github.com/ipfs/go-ipfs-api"
+)
+
+var ErrUnknownScheme = errors.New("No storage registered for the URL scheme")
+var ErrInvalidStorageURL = errors.New("Invalid storage URL")
+
+// Opener creates a storage from its URL
+// The query parameters handled by Open, like cache or verify, are already removed
+type Opener func(u *url.URL) (Storage, error)
+
+var (
+	openersMutex sync.RWMutex
+	openers      = make(map[string]Opener)
+)
+
+func init() {
+	Register("mem", openMemory)
+	Register("redis", openRedis)
+	Register("rediss", openRedis)
+	Register("ipfs", openIPFS)
+	Register("ipfs+https", openIPFS)
+	Register("file", openCar)
+}
+
+// Register makes a storage available to Open under the URL scheme
+// It's meant to be called from the init function of the package implementing the storage,
+// and panics if the scheme is already registered
+func Register(scheme string, opener Opener) {
+	openersMutex.Lock()
+	defer openersMutex.Unlock()
+
+	if opener == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, exists := openers[scheme]; exists {
+		panic("storage: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = opener
+}
+
+// Schemes returns the sorted list of registered URL schemes
+func Schemes() []string {
+	openersMutex.RLock()
+	defer openersMutex.RUnlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open creates the storage described by rawURL using the opener registered for its scheme.
+// The built-in schemes are:
+//
+//	mem://?max=64MB                               Memory, optionally bounded
+//	redis://:passwd@host:6379/0?prefix=a:&ttl=1h  Redis, rediss:// for TLS, refcount=true enables Retain/Release
+//	ipfs://localhost:5001?pin=latest              IPFS HTTP API, ipfs+https:// for TLS, pin is none, roots or latest
+//	file:///tmp/files.car                         read-only CAR file
+//
+// Whatever the scheme, these query parameters wrap the storage:
+//
+//	compress=zstd  compresses the blocks with gzip, zstd or snappy
+//	verify=true    verifies the blocks read against their link
+//	cache=64MB     caches up to the given size of blocks in memory
+//	readonly=true  fails every write with ErrReadOnlyStorage
+//
+// The storage may hold files or connections, release them with Close once done.
+func Open(rawURL string) (Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	openersMutex.RLock()
+	opener, exists := openers[u.Scheme]
+	openersMutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownScheme, u.Scheme)
+	}
+
+	query := u.Query()
+	compress, verify, cache := query.Get("compress"), query.Get("verify"), query.Get("cache")
+	readOnly := query.Get("readonly")
+	query.Del("compress")
+	query.Del("verify")
+	query.Del("cache")
+	query.Del("readonly")
+	u.RawQuery = query.Encode()
+
+	store, err := opener(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks are verified once decompressed, and cached once verified
+	if compress != "" {
+		algo, err := parseCompression(compress)
+		if err != nil {
+			return nil, err
+		}
+		store = NewCompressedStorage(store, algo)
+	}
+
+	if verify != "" {
+		enabled, err := strconv.ParseBool(verify)
+		if err != nil {
+			return nil, fmt.Errorf("%w: verify=%s", ErrInvalidStorageURL, verify)
+		}
+		if enabled {
+			store = NewVerifyingStorage(store)
+		}
+	}
+
+	if cache != "" {
+		maxBytes, err := ParseSize(cache)
+		if err != nil {
+			return nil, err
+		}
+		store = NewCachedStorage(store, maxBytes)
+	}
+
+	if readOnly != "" {
+		enabled, err := strconv.ParseBool(readOnly)
+		if err != nil {
+			return nil, fmt.Errorf("%w: readonly=%s", ErrInvalidStorageURL, readOnly)
+		}
+		if enabled {
+			store = Chain(store, ReadOnly())
+		}
+	}
+
+	return store, nil
+}
+
+// ParseSize parses sizes like 512, 64KB, 64MB or 1GiB into bytes
+// Units are powers of 1024, with or without the i
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+
+	number, multiplier := strings.ToUpper(strings.TrimSpace(size)), int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("%w: invalid size %q", ErrInvalidStorageURL, size)
+	}
+
+	return value * multiplier, nil
+}
+
+func parseCompression(name string) (CompressionAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedCompression, name)
+	}
+}
+
+func openMemory(u *url.URL) (Storage, error) {
+	var options []MemoryOption
+
+	if max := u.Query().Get("max"); max != "" {
+		maxBytes, err := ParseSize(max)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, WithMaxBytes(maxBytes))
+	}
+
+	return NewMemoryStorageWithOptions(options...), nil
+}
+
+func openRedis(u *url.URL) (Storage, error) {
+	query := u.Query()
+	options := []RedisOption{WithKeyPrefix(query.Get("prefix"))}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("%w: ttl=%s", ErrInvalidStorageURL, ttl)
+		}
+		options = append(options, WithTTL(duration))
+	}
+
+	if refCount := query.Get("refcount"); refCount != "" {
+		enabled, err := strconv.ParseBool(refCount)
+		if err != nil {
+			return nil, fmt.Errorf("%w: refcount=%s", ErrInvalidStorageURL, refCount)
+		}
+		if enabled {
+			options = append(options, WithRefCounting())
+		}
+	}
+
+	// The Redis client doesn't accept query parameters
+	clientURL := *u
+	clientURL.RawQuery = ""
+	options = append(options, WithRedisURL(clientURL.String()))
+
+	return NewRedisStorageWithOptions(options...)
+}
+
+func openIPFS(u *url.URL) (Storage, error) {
+	host := u.Host
+	if host == "" {
+		host = "localhost:5001"
+	}
+
+	scheme := "http"
+	if u.Scheme == "ipfs+https" {
+		scheme = "https"
+	}
+
+	var options []IPFSOption
+	switch pin := u.Query().Get("pin"); pin {
+	case "", "none":
+	case "roots":
+		options = append(options, WithPinPolicy(PinRoots))
+	case "latest":
+		options = append(options, WithPinPolicy(PinLatestRoot))
+	default:
+		return nil, fmt.Errorf("%w: pin=%s", ErrInvalidStorageURL, pin)
+	}
+
+	return NewIPFSStorageWithOptions(ipfsApi.NewShell(scheme+"://"+host), options...), nil
+}
+
+func openCar(u *url.URL) (Storage, error) {
+	// file://files.car is a relative path
+	path := u.Host + u.Path
+	if path == "" {
+		return nil, fmt.Errorf("%w: missing file path", ErrInvalidStorageURL)
+	}
+
+	return NewCarStorage(path)
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage/ipfstest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageOpenBuiltins(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := Open("mem://?max=1KB")
+	assert.Nil(err)
+	assert.Equal(int64(1024), store.(*Memory).maxBytes)
+
+	server, err := miniredis.Run()
+	assert.Nil(err)
+	defer server.Close()
+
+	store, err = Open("redis://" + server.Addr() + "/0?prefix=tenant:&ttl=1h&refcount=true")
+	assert.Nil(err)
+	redisStore := store.(*Redis)
+	assert.Equal("tenant:", redisStore.keyPrefix)
+	assert.Equal(time.Hour, redisStore.ttl)
+	assert.True(redisStore.refCount)
+
+	lnk := storeTestNode(t, store, "world")
+	assert.True(server.Exists("tenant:" + lnk.String()))
+
+	// The client created for the URL is closed with the storage
+	assert.Nil(Close(store))
+	_, err = store.OpenRead(ipld.LinkContext{}, lnk)
+	assert.NotNil(err)
+
+	ipfsServer := ipfstest.NewServer()
+	defer ipfsServer.Close()
+
+	ipfsURL, err := url.Parse(ipfsServer.URL)
+	assert.Nil(err)
+	store, err = Open("ipfs://" + ipfsURL.Host + "?pin=latest")
+	assert.Nil(err)
+	assert.Equal(PinLatestRoot, store.(*IPFS).pinPolicy)
+
+	storeTestNode(t, store, "world")
+	assert.Equal(1, ipfsServer.Len())
+
+	carLink, v1 := writeTestCarV1(t)
+	path := filepath.Join(t.TempDir(), "files.car")
+	assert.Nil(ioutil.WriteFile(path, v1, 0644))
+
+	store, err = Open("file://" + path + "?cache=1MB")
+	assert.Nil(err)
+	mustReadBlock(t, store, carLink)
+
+	// The file is closed through the cache
+	assert.Nil(Close(store))
+	assert.NotNil(store.(*Cached).inner.(*Car).Close())
+
+	_, err = Open("file://" + filepath.Join(t.TempDir(), "missing.car"))
+	assert.NotNil(err)
+}
+
+func TestStorageOpenWrappers(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := Open("mem://?compress=zstd&verify=true&cache=64MB")
+	assert.Nil(err)
+
+	cached, ok := store.(*Cached)
+	assert.True(ok)
+	assert.Equal(int64(64<<20), cached.maxBytes)
+
+	verifying, ok := cached.inner.(*Verifying)
+	assert.True(ok)
+
+	compressed, ok := verifying.inner.(*Compressed)
+	assert.True(ok)
+	assert.Equal(CompressionZstd, compressed.algo)
+	assert.IsType(&Memory{}, compressed.inner)
+
+	lnk := storeTestNode(t, store, "world")
+	mustReadBlock(t, store, lnk)
+
+	store, err = Open("mem://?verify=false")
+	assert.Nil(err)
+	assert.IsType(&Memory{}, store)
+
+	store, err = Open("mem://?readonly=true")
+	assert.Nil(err)
+	_, _, err = store.OpenWrite(ipld.LinkContext{})
+	assert.ErrorIs(err, ErrReadOnlyStorage)
+
+	for _, rawURL := range []string{
+		"mem://?compress=lz4",
+		"mem://?verify=maybe",
+		"mem://?cache=lots",
+		"mem://?max=-1",
+		"mem://?readonly=sure",
+		"redis://localhost?ttl=forever",
+		"ipfs://localhost?pin=everything",
+	} {
+		_, err := Open(rawURL)
+		assert.NotNil(err, rawURL)
+	}
+}
+
+func TestStorageOpenUnknownScheme(t *testing.T) {
+	_, err := Open("s3://bucket/blocks")
+	assert.True(t, errors.Is(err, ErrUnknownScheme))
+}
+
+func TestStorageRegister(t *testing.T) {
+	assert := assert.New(t)
+
+	var opened *url.URL
+	Register("test-scheme", func(u *url.URL) (Storage, error) {
+		opened = u
+		return NewMemoryStorage(), nil
+	})
+	assert.Contains(Schemes(), "test-scheme")
+
+	store, err := Open("test-scheme://somewhere?bucket=blocks&verify=true")
+	assert.Nil(err)
+	assert.IsType(&Verifying{}, store)
+
+	// Parameters handled by Open are not passed down
+	assert.Equal("somewhere", opened.Host)
+	assert.Equal("bucket=blocks", opened.RawQuery)
+
+	assert.Panics(func() {
+		Register("test-scheme", func(u *url.URL) (Storage, error) { return nil, nil })
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	assert := assert.New(t)
+
+	for size, expected := range map[string]int64{
+		"512":    512,
+		"512B":   512,
+		"64KB":   64 << 10,
+		"64k":    64 << 10,
+		"64MB":   64 << 20,
+		"64 MiB": 64 << 20,
+		"1GiB":   1 << 30,
+		"2g":     2 << 30,
+	} {
+		actual, err := ParseSize(size)
+		assert.Nil(err, size)
+		assert.Equal(expected, actual, size)
+	}
+
+	for _, size := range []string{"", "MB", "1.5MB", "-1", "1TB", "8589934592GB", "9223372036854775808"} {
+		_, err := ParseSize(size)
+		assert.ErrorIs(err, ErrInvalidStorageURL, size)
+	}
+}
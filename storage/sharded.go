@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+var ErrShardNotListable = errors.New("Shard can't be rebalanced, it must implement Lister and Deleter")
+var ErrNoShards = errors.New("Sharded storage has no shards")
+
+// Virtual nodes of each shard on the ring, smoothing the distribution of blocks
+const shardVirtualNodes = 128
+
+// Sharded spreads blocks over many backends by consistent hashing of their CID.
+// Shards are identified by their position, so backends must always be given
+// in the same order, new ones being added at the end with AddShard.
+//
+// Adding a shard only moves the blocks the new shard takes over, which
+// Rebalance does. Meanwhile blocks missing from their shard are looked up
+// on the other ones, so nothing goes missing while rebalancing.
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewShardedStorage(redisStore1, redisStore2, redisStore3)
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Sharded struct {
+	mutex  sync.RWMutex
+	shards []Storage
+	ring   []shardPoint
+}
+
+type shardPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewShardedStorage creates a storage spreading blocks over the backends
+func NewShardedStorage(backends ...Storage) *Sharded {
+	store := &Sharded{}
+	for _, backend := range backends {
+		store.AddShard(backend)
+	}
+	return store
+}
+
+// AddShard adds a backend at the end of the shards and returns its position
+// Blocks it takes over stay on their previous shard until Rebalance
+func (store *Sharded) AddShard(backend Storage) int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	shard := len(store.shards)
+	store.shards = append(store.shards, backend)
+
+	for v := 0; v < shardVirtualNodes; v++ {
+		store.ring = append(store.ring, shardPoint{hashOf([]byte(fmt.Sprintf("shard-%d-%d", shard, v))), shard})
+	}
+	sort.Slice(store.ring, func(i, j int) bool {
+		return store.ring[i].hash < store.ring[j].hash
+	})
+
+	return shard
+}
+
+// Shards returns the backends in their position order
+func (store *Sharded) Shards() []Storage {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return append([]Storage{}, store.shards...)
+}
+
+// ShardOf returns the position of the shard owning the block, -1 without shards
+func (store *Sharded) ShardOf(lnk ipld.Link) int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	shard, ok := store.shardOf(lnk)
+	if !ok {
+		return -1
+	}
+	return shard
+}
+
+// shardOf must be called with the mutex held, it's false without shards
+func (store *Sharded) shardOf(lnk ipld.Link) (int, bool) {
+	if len(store.ring) == 0 {
+		return 0, false
+	}
+
+	// The multihash is the block identity, whatever the CID version or codec
+	key := []byte(lnk.String())
+	if theCid, ok := lnk.(cidlink.Link); ok {
+		key = theCid.Hash()
+	}
+
+	hash := hashOf(key)
+	i := sort.Search(len(store.ring), func(i int) bool {
+		return store.ring[i].hash >= hash
+	})
+	if i == len(store.ring) {
+		i = 0
+	}
+
+	return store.ring[i].shard, true
+}
+
+// route returns the owner of the block followed by the other shards, none without shards
+func (store *Sharded) route(lnk ipld.Link) []Storage {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	owner, ok := store.shardOf(lnk)
+	if !ok {
+		return nil
+	}
+
+	shards := []Storage{store.shards[owner]}
+	for i, shard := range store.shards {
+		if i != owner {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+func (store *Sharded) owner(lnk ipld.Link) (Storage, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	shard, ok := store.shardOf(lnk)
+	if !ok {
+		return nil, ErrNoShards
+	}
+	return store.shards[shard], nil
+}
+
+func (store *Sharded) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	for _, shard := range store.route(lnk) {
+		reader, err := shard.OpenRead(lnkCtx, lnk)
+		if !errors.Is(err, ErrDataNotFound) {
+			return reader, err
+		}
+	}
+
+	return nil, ErrDataNotFound
+}
+
+func (store *Sharded) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	store.mutex.RLock()
+	empty := len(store.shards) == 0
+	store.mutex.RUnlock()
+	if empty {
+		return nil, nil, ErrNoShards
+	}
+
+	buf := bytes.Buffer{}
+	return &buf, func(lnk ipld.Link) error {
+		owner, err := store.owner(lnk)
+		if err != nil {
+			return err
+		}
+		return writeBlock(owner, lnkCtx, lnk, buf.Bytes())
+	}, nil
+}
+
+// PutMany writes the blocks of each shard in a single batch when the shard supports it
+func (store *Sharded) PutMany(ctx context.Context, blocks []Block) error {
+	store.mutex.RLock()
+	batches := make(map[int][]Block)
+	for _, block := range blocks {
+		shard, ok := store.shardOf(block.Link)
+		if !ok {
+			store.mutex.RUnlock()
+			return ErrNoShards
+		}
+		batches[shard] = append(batches[shard], block)
+	}
+	shards := store.shards
+	store.mutex.RUnlock()
+
+	for shard, batch := range batches {
+		if err := putMany(ctx, shards[shard], batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Has tells if any shard holds the block, the owner being asked first
+// Shards which aren't a Haser are read instead
+func (store *Sharded) Has(ctx context.Context, lnk ipld.Link) (bool, error) {
+	for _, shard := range store.route(lnk) {
+		has, err := hasBlock(ctx, shard, lnk)
+		if err != nil || has {
+			return has, err
+		}
+	}
+
+	return false, nil
+}
+
+// Delete removes the block from every shard, it may not have been rebalanced yet
+func (store *Sharded) Delete(ctx context.Context, lnk ipld.Link) error {
+	for _, shard := range store.Shards() {
+		deleter, ok := shard.(Deleter)
+		if !ok {
+			return ErrShardNotListable
+		}
+
+		if err := deleter.Delete(ctx, lnk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List calls fn once with the link of every block of every shard
+func (store *Sharded) List(ctx context.Context, fn func(lnk ipld.Link) error) error {
+	seen := make(map[ipld.Link]struct{})
+
+	for _, shard := range store.Shards() {
+		lister, ok := shard.(Lister)
+		if !ok {
+			return ErrShardNotListable
+		}
+
+		err := lister.List(ctx, func(lnk ipld.Link) error {
+			// Blocks being rebalanced may be on two shards
+			if _, exists := seen[lnk]; exists {
+				return nil
+			}
+			seen[lnk] = struct{}{}
+			return fn(lnk)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refCounter is implemented by storages counting references to their blocks,
+// like Redis with WithRefCounting, Rebalance moves the count along with the block
+type refCounter interface {
+	refs(ctx context.Context, lnk ipld.Link) (int64, error)
+	addRefs(ctx context.Context, lnk ipld.Link, refs int64) error
+}
+
+// Rebalance moves the blocks stored on a shard other than their owner, like
+// after AddShard, and returns how many were moved
+// Every shard must be a Lister and a Deleter. Reference counts of retained
+// blocks are moved too, the owner must count references as well.
+func (store *Sharded) Rebalance(ctx context.Context) (int, error) {
+	shards := store.Shards()
+
+	moved := 0
+	for i, shard := range shards {
+		lister, listable := shard.(Lister)
+		deleter, deletable := shard.(Deleter)
+		if !listable || !deletable {
+			return moved, ErrShardNotListable
+		}
+
+		var misplaced []ipld.Link
+		err := lister.List(ctx, func(lnk ipld.Link) error {
+			if store.ShardOf(lnk) != i {
+				misplaced = append(misplaced, lnk)
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+
+		for _, lnk := range misplaced {
+			data, err := readBlock(shard, ipld.LinkContext{Ctx: ctx}, lnk)
+			if err != nil {
+				return moved, err
+			}
+
+			owner, err := store.owner(lnk)
+			if err != nil {
+				return moved, err
+			}
+
+			// Counted before written, so the block is written without TTL
+			if counter, ok := shard.(refCounter); ok {
+				refs, err := counter.refs(ctx, lnk)
+				if err != nil {
+					return moved, err
+				}
+
+				if refs > 0 {
+					ownerCounter, ok := owner.(refCounter)
+					if !ok {
+						return moved, ErrRefCountingDisabled
+					}
+					if err := ownerCounter.addRefs(ctx, lnk, refs); err != nil {
+						return moved, err
+					}
+				}
+			}
+
+			// Copied before deleted, so the block is always readable
+			if err := writeBlock(owner, ipld.LinkContext{Ctx: ctx}, lnk, data); err != nil {
+				return moved, err
+			}
+
+			if err := deleter.Delete(ctx, lnk); err != nil {
+				return moved, err
+			}
+
+			moved++
+		}
+	}
+
+	return moved, nil
+}
+
+// hasBlock tells if the storage holds the block, reading it unless it's a Haser
+func hasBlock(ctx context.Context, store Storage, lnk ipld.Link) (bool, error) {
+	if haser, ok := store.(Haser); ok {
+		return haser.Has(ctx, lnk)
+	}
+
+	_, err := store.OpenRead(ipld.LinkContext{Ctx: ctx}, lnk)
+	if errors.Is(err, ErrDataNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// hashOf places data on the ring, short similar keys must still spread evenly
+func hashOf(data []byte) uint64 {
+	sum := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (store *Sharded) unwrap() []Storage {
+	return store.Shards()
+}
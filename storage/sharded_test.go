@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+func storeTestNodes(t *testing.T, store Storage, count int) []ipld.Link {
+	links := make([]ipld.Link, count)
+	for i := range links {
+		links[i] = storeTestNode(t, store, fmt.Sprintf("value-%d", i))
+	}
+	return links
+}
+
+func TestStorageShardedDistribution(t *testing.T) {
+	assert := assert.New(t)
+
+	shards := []Storage{NewMemoryStorage(), NewMemoryStorage(), NewMemoryStorage()}
+	store := NewShardedStorage(shards...)
+	links := storeTestNodes(t, store, 600)
+
+	for i, shard := range shards {
+		held := shard.(*Memory).Len()
+		assert.True(held > 100 && held < 350, "shard %d holds %d blocks", i, held)
+	}
+
+	for _, lnk := range links {
+		// Each block lives on its owner only
+		has, err := shards[store.ShardOf(lnk)].(Haser).Has(context.Background(), lnk)
+		assert.Nil(err)
+		assert.True(has)
+
+		mustReadBlock(t, store, lnk)
+	}
+}
+
+func TestStorageShardedHasListDelete(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store := NewShardedStorage(NewMemoryStorage(), NewMemoryStorage())
+	links := storeTestNodes(t, store, 20)
+
+	var listed []ipld.Link
+	assert.Nil(store.List(ctx, func(lnk ipld.Link) error {
+		listed = append(listed, lnk)
+		return nil
+	}))
+	assert.ElementsMatch(links, listed)
+
+	has, err := store.Has(ctx, links[0])
+	assert.Nil(err)
+	assert.True(has)
+
+	assert.Nil(store.Delete(ctx, links[0]))
+	has, err = store.Has(ctx, links[0])
+	assert.Nil(err)
+	assert.False(has)
+
+	_, err = store.OpenRead(ipld.LinkContext{}, links[0])
+	assert.ErrorIs(err, ErrDataNotFound)
+
+	// Deleting twice is fine
+	assert.Nil(store.Delete(ctx, links[0]))
+}
+
+func TestStorageShardedRebalance(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store := NewShardedStorage(NewMemoryStorage(), NewMemoryStorage(), NewMemoryStorage())
+	links := storeTestNodes(t, store, 300)
+
+	before := make(map[ipld.Link]int)
+	for _, lnk := range links {
+		before[lnk] = store.ShardOf(lnk)
+	}
+
+	added := NewMemoryStorage()
+	assert.Equal(3, store.AddShard(added))
+
+	// Only blocks taken over by the new shard change owner
+	affected := 0
+	for _, lnk := range links {
+		if owner := store.ShardOf(lnk); owner != before[lnk] {
+			assert.Equal(3, owner)
+			affected++
+		}
+	}
+	assert.True(affected > 0)
+
+	// Still readable before rebalancing
+	for _, lnk := range links {
+		mustReadBlock(t, store, lnk)
+	}
+
+	moved, err := store.Rebalance(ctx)
+	assert.Nil(err)
+	assert.Equal(affected, moved)
+	assert.Equal(affected, added.(*Memory).Len())
+
+	total := 0
+	for _, shard := range store.Shards() {
+		total += shard.(*Memory).Len()
+	}
+	assert.Equal(len(links), total)
+
+	for _, lnk := range links {
+		mustReadBlock(t, store.Shards()[store.ShardOf(lnk)], lnk)
+	}
+
+	// Nothing left to move
+	moved, err = store.Rebalance(ctx)
+	assert.Nil(err)
+	assert.Equal(0, moved)
+}
+
+func TestStorageShardedRebalanceRefCounted(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	first, firstServer := newMiniredisStorage(t, WithTTL(time.Minute), WithRefCounting())
+	store := NewShardedStorage(first)
+
+	links := storeTestNodes(t, store, 20)
+	for _, lnk := range links {
+		assert.Nil(first.Retain(ctx, lnk))
+	}
+
+	second, secondServer := newMiniredisStorage(t, WithTTL(time.Minute), WithRefCounting())
+	store.AddShard(second)
+
+	moved, err := store.Rebalance(ctx)
+	assert.Nil(err)
+	assert.True(moved > 0)
+
+	// Moved blocks are still retained, so they don't expire
+	firstServer.FastForward(time.Hour)
+	secondServer.FastForward(time.Hour)
+
+	for _, lnk := range links {
+		mustReadBlock(t, store, lnk)
+
+		owner := store.Shards()[store.ShardOf(lnk)].(*Redis)
+		refs, err := owner.refs(ctx, lnk)
+		assert.Nil(err)
+		assert.Equal(int64(1), refs)
+	}
+
+	// Released on their new shard, they expire as usual
+	var kept []ipld.Link
+	for _, lnk := range links {
+		if store.ShardOf(lnk) == 1 {
+			assert.Nil(second.Release(ctx, lnk))
+		} else {
+			kept = append(kept, lnk)
+		}
+	}
+	secondServer.FastForward(time.Hour)
+	assert.Empty(secondServer.Keys())
+
+	// Retained blocks can't be moved to a shard without reference counts
+	store = NewShardedStorage(first, NewMemoryStorage(), NewMemoryStorage())
+	_, err = store.Rebalance(ctx)
+	assert.ErrorIs(err, ErrRefCountingDisabled)
+	for _, lnk := range kept {
+		mustReadBlock(t, first, lnk)
+	}
+}
+
+func TestStorageShardedRebalanceNeedsLister(t *testing.T) {
+	// Embedding hides the extended interfaces of the memory storage
+	store := NewShardedStorage(struct{ Storage }{NewMemoryStorage()})
+
+	_, err := store.Rebalance(context.Background())
+	assert.ErrorIs(t, err, ErrShardNotListable)
+}
+
+func TestStorageShardedWithoutShards(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	lnk := storeTestNode(t, NewMemoryStorage(), "world")
+	store := NewShardedStorage()
+	assert.Equal(-1, store.ShardOf(lnk))
+
+	_, err := store.OpenRead(ipld.LinkContext{}, lnk)
+	assert.ErrorIs(err, ErrDataNotFound)
+
+	has, err := store.Has(ctx, lnk)
+	assert.Nil(err)
+	assert.False(has)
+
+	_, _, err = store.OpenWrite(ipld.LinkContext{})
+	assert.ErrorIs(err, ErrNoShards)
+	assert.ErrorIs(store.PutMany(ctx, []Block{{Link: lnk, Data: []byte("data")}}), ErrNoShards)
+
+	moved, err := store.Rebalance(ctx)
+	assert.Nil(err)
+	assert.Equal(0, moved)
+}
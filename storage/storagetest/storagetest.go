@@ -0,0 +1,427 @@
+// Package storagetest provides a conformance test suite for storage backends,
+// so the built-in storages and custom ones are held to the same behaviour.
+//
+//	func TestMyStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return NewMyStorage()
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/fluent"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/multiformats/go-multihash"
+	"github.com/simplecoincom/go-ipld-adl-hamt-container/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// Factory returns a new empty storage for each test of the suite
+type Factory func(t *testing.T) storage.Storage
+
+// Option tunes the suite for the storage under test
+type Option func(*suite)
+
+type suite struct {
+	factory        Factory
+	concurrency    int
+	largeBlockSize int
+}
+
+// WithoutConcurrency skips the concurrent writers test, for storages not safe for concurrent use
+func WithoutConcurrency() Option {
+	return func(s *suite) {
+		s.concurrency = 0
+	}
+}
+
+// WithLargeBlockSize sets the size of the block written by the large blocks test, 1MiB by default
+func WithLargeBlockSize(size int) Option {
+	return func(s *suite) {
+		s.largeBlockSize = size
+	}
+}
+
+// Run runs the whole suite against the storages returned by factory
+// The tests of the optional capabilities, like storage.BatchPutter or
+// storage.MultiGetter, only run when the storage implements them
+func Run(t *testing.T, factory Factory, options ...Option) {
+	s := &suite{
+		factory:        factory,
+		concurrency:    8,
+		largeBlockSize: 1 << 20,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+
+	t.Run("RoundTrip", s.testRoundTrip)
+	t.Run("LinkSystem", s.testLinkSystem)
+	t.Run("MissingBlock", s.testMissingBlock)
+	t.Run("Overwrite", s.testOverwrite)
+	t.Run("LargeBlock", s.testLargeBlock)
+	t.Run("ConcurrentWriters", s.testConcurrentWriters)
+	t.Run("BatchPutter", s.testBatchPutter)
+	t.Run("MultiGetter", s.testMultiGetter)
+	t.Run("Prefetcher", s.testPrefetcher)
+	t.Run("Flusher", s.testFlusher)
+	t.Run("Haser", s.testHaser)
+	t.Run("Deleter", s.testDeleter)
+	t.Run("Lister", s.testLister)
+}
+
+// RandomBlock returns a raw block of size random bytes
+func RandomBlock(t *testing.T, size int) storage.Block {
+	t.Helper()
+
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.Block{Link: cidlink.Link{Cid: c}, Data: data}
+}
+
+// Put writes the block through the storage OpenWrite
+func Put(t *testing.T, store storage.Storage, block storage.Block) {
+	t.Helper()
+
+	if err := put(store, block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Get reads the block data through the storage OpenRead
+func Get(store storage.Storage, lnk ipld.Link) ([]byte, error) {
+	reader, err := store.OpenRead(ipld.LinkContext{}, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+func (s *suite) testRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	first, second := RandomBlock(t, 64), RandomBlock(t, 64)
+	Put(t, store, first)
+	Put(t, store, second)
+
+	for _, block := range []storage.Block{first, second} {
+		data, err := Get(store, block.Link)
+		assert.Nil(err)
+		assert.Equal(block.Data, data)
+	}
+}
+
+func (s *suite) testLinkSystem(t *testing.T) {
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = store.OpenRead
+	lsys.StorageWriteOpener = store.OpenWrite
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   multihash.SHA2_512,
+		MhLength: 64,
+	}}
+
+	n := fluent.MustBuildMap(basicnode.Prototype.Map, 1, func(na fluent.MapAssembler) {
+		na.AssembleEntry("hello").AssignString("world")
+	})
+
+	lnk, err := lsys.Store(ipld.LinkContext{}, lp, n)
+	assert.Nil(err)
+
+	loaded, err := lsys.Load(ipld.LinkContext{}, lnk, basicnode.Prototype.Any)
+	assert.Nil(err)
+	assert.True(ipld.DeepEqual(n, loaded))
+}
+
+func (s *suite) testMissingBlock(t *testing.T) {
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	_, err := store.OpenRead(ipld.LinkContext{}, RandomBlock(t, 64).Link)
+	assert.True(errors.Is(err, storage.ErrDataNotFound), "expected ErrDataNotFound, got %v", err)
+}
+
+func (s *suite) testOverwrite(t *testing.T) {
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	// Blocks are immutable, writing the same one twice is harmless
+	block := RandomBlock(t, 64)
+	Put(t, store, block)
+	Put(t, store, block)
+
+	data, err := Get(store, block.Link)
+	assert.Nil(err)
+	assert.Equal(block.Data, data)
+}
+
+func (s *suite) testLargeBlock(t *testing.T) {
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	block := RandomBlock(t, s.largeBlockSize)
+	Put(t, store, block)
+
+	data, err := Get(store, block.Link)
+	assert.Nil(err)
+	assert.True(bytes.Equal(block.Data, data), "large block doesn't round trip")
+}
+
+func (s *suite) testConcurrentWriters(t *testing.T) {
+	if s.concurrency == 0 {
+		t.Skip("storage isn't safe for concurrent use")
+	}
+
+	assert := assert.New(t)
+	store := s.factory(t)
+
+	const perWriter = 16
+	blocks := make([]storage.Block, s.concurrency*perWriter)
+	for i := range blocks {
+		blocks[i] = RandomBlock(t, 128)
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(blocks))
+	for w := 0; w < s.concurrency; w++ {
+		wg.Add(1)
+		go func(blocks []storage.Block) {
+			defer wg.Done()
+			for _, block := range blocks {
+				errs <- put(store, block)
+			}
+		}(blocks[w*perWriter : (w+1)*perWriter])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(err)
+	}
+
+	for _, block := range blocks {
+		data, err := Get(store, block.Link)
+		assert.Nil(err)
+		assert.Equal(block.Data, data)
+	}
+}
+
+func (s *suite) testBatchPutter(t *testing.T) {
+	store := s.factory(t)
+	batchPutter, ok := store.(storage.BatchPutter)
+	if !ok {
+		t.Skip("storage isn't a BatchPutter")
+	}
+
+	assert := assert.New(t)
+
+	blocks := []storage.Block{RandomBlock(t, 64), RandomBlock(t, 64), RandomBlock(t, 64)}
+	assert.Nil(batchPutter.PutMany(context.Background(), blocks))
+	flush(t, store)
+
+	for _, block := range blocks {
+		data, err := Get(store, block.Link)
+		assert.Nil(err)
+		assert.Equal(block.Data, data)
+	}
+}
+
+func (s *suite) testMultiGetter(t *testing.T) {
+	store := s.factory(t)
+	multiGetter, ok := store.(storage.MultiGetter)
+	if !ok {
+		t.Skip("storage isn't a MultiGetter")
+	}
+
+	assert := assert.New(t)
+
+	first, second, missing := RandomBlock(t, 64), RandomBlock(t, 64), RandomBlock(t, 64)
+	Put(t, store, first)
+	Put(t, store, second)
+
+	// Missing blocks are left out of the result
+	blocks, err := multiGetter.GetMany(context.Background(), []ipld.Link{first.Link, missing.Link, second.Link})
+	assert.Nil(err)
+	assert.ElementsMatch([]storage.Block{first, second}, blocks)
+}
+
+func (s *suite) testPrefetcher(t *testing.T) {
+	store := s.factory(t)
+	prefetcher, ok := store.(storage.Prefetcher)
+	if !ok {
+		t.Skip("storage isn't a Prefetcher")
+	}
+
+	assert := assert.New(t)
+
+	block, missing := RandomBlock(t, 64), RandomBlock(t, 64)
+	Put(t, store, block)
+
+	assert.Nil(prefetcher.Prefetch(context.Background(), []ipld.Link{block.Link, missing.Link}))
+
+	data, err := Get(store, block.Link)
+	assert.Nil(err)
+	assert.Equal(block.Data, data)
+}
+
+func (s *suite) testFlusher(t *testing.T) {
+	store := s.factory(t)
+	if _, ok := store.(storage.Flusher); !ok {
+		t.Skip("storage isn't a Flusher")
+	}
+
+	assert := assert.New(t)
+
+	block := RandomBlock(t, 64)
+	Put(t, store, block)
+	flush(t, store)
+	flush(t, store)
+
+	data, err := Get(store, block.Link)
+	assert.Nil(err)
+	assert.Equal(block.Data, data)
+}
+
+func (s *suite) testHaser(t *testing.T) {
+	store := s.factory(t)
+	haser, ok := store.(storage.Haser)
+	if !ok {
+		t.Skip("storage isn't a Haser")
+	}
+
+	assert := assert.New(t)
+
+	block, missing := RandomBlock(t, 64), RandomBlock(t, 64)
+	Put(t, store, block)
+	flush(t, store)
+
+	has, err := haser.Has(context.Background(), block.Link)
+	assert.Nil(err)
+	assert.True(has)
+
+	has, err = haser.Has(context.Background(), missing.Link)
+	assert.Nil(err)
+	assert.False(has)
+}
+
+func (s *suite) testDeleter(t *testing.T) {
+	store := s.factory(t)
+	deleter, ok := store.(storage.Deleter)
+	if !ok {
+		t.Skip("storage isn't a Deleter")
+	}
+
+	assert := assert.New(t)
+
+	deleted, kept := RandomBlock(t, 64), RandomBlock(t, 64)
+	Put(t, store, deleted)
+	Put(t, store, kept)
+	flush(t, store)
+
+	assert.Nil(deleter.Delete(context.Background(), deleted.Link))
+	_, err := Get(store, deleted.Link)
+	assert.True(errors.Is(err, storage.ErrDataNotFound), "expected ErrDataNotFound, got %v", err)
+
+	data, err := Get(store, kept.Link)
+	assert.Nil(err)
+	assert.Equal(kept.Data, data)
+
+	// Deleting a missing block isn't an error
+	assert.Nil(deleter.Delete(context.Background(), deleted.Link))
+}
+
+func (s *suite) testLister(t *testing.T) {
+	store := s.factory(t)
+	lister, ok := store.(storage.Lister)
+	if !ok {
+		t.Skip("storage isn't a Lister")
+	}
+
+	assert := assert.New(t)
+
+	var links []ipld.Link
+	for i := 0; i < 8; i++ {
+		block := RandomBlock(t, 64)
+		Put(t, store, block)
+		links = append(links, block.Link)
+	}
+	flush(t, store)
+
+	var listed []ipld.Link
+	assert.Nil(lister.List(context.Background(), func(lnk ipld.Link) error {
+		listed = append(listed, lnk)
+		return nil
+	}))
+	assert.ElementsMatch(links, listed)
+
+	// Errors stop the listing
+	stop := errors.New("stop")
+	calls := 0
+	err := lister.List(context.Background(), func(lnk ipld.Link) error {
+		calls++
+		return stop
+	})
+	assert.True(errors.Is(err, stop))
+	assert.Equal(1, calls)
+}
+
+// put is Put for goroutines, which can't stop the test
+func put(store storage.Storage, block storage.Block) error {
+	writer, commit, err := store.OpenWrite(ipld.LinkContext{})
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(block.Data); err != nil {
+		return err
+	}
+
+	if err := commit(block.Link); err != nil {
+		return fmt.Errorf("committing %s: %w", block.Link, err)
+	}
+
+	return nil
+}
+
+func flush(t *testing.T, store storage.Storage) {
+	t.Helper()
+
+	if flusher, ok := store.(storage.Flusher); ok {
+		if err := flusher.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime"
+)
+
+// SyncStats counts the blocks handled by Sync
+type SyncStats struct {
+	// Blocks copied to the destination
+	Copied int64
+	// Blocks already in the destination, their links weren't followed
+	Skipped int64
+	// Bytes of the blocks copied
+	Bytes int64
+}
+
+// SyncProgressFunc is called after each block copied or skipped, never concurrently
+type SyncProgressFunc func(lnk ipld.Link, stats SyncStats)
+
+// SyncOption tunes Sync
+type SyncOption func(*syncer)
+
+// WithSyncParallelism sets how many reads and writes run at once, 8 by default
+func WithSyncParallelism(parallelism int) SyncOption {
+	return func(s *syncer) {
+		if parallelism < 1 {
+			parallelism = 1
+		}
+		s.slots = make(chan struct{}, parallelism)
+	}
+}
+
+// WithSyncProgress reports the progress of Sync to fn
+func WithSyncProgress(fn SyncProgressFunc) SyncOption {
+	return func(s *syncer) {
+		s.progress = fn
+	}
+}
+
+// Sync copies the DAG under root, nested containers included, from src to dst.
+// Blocks dst already holds are skipped along with everything they link to.
+//
+// A block is only written once every block it links to is, so dst never
+// holds a block whose DAG is incomplete and an interrupted Sync can simply
+// be run again, resuming where it stopped.
+func Sync(ctx context.Context, root ipld.Link, src Storage, dst Storage, options ...SyncOption) (SyncStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &syncer{
+		ctx:    ctx,
+		cancel: cancel,
+		src:    src,
+		dst:    dst,
+		slots:  make(chan struct{}, 8),
+		tasks:  make(map[ipld.Link]*syncTask),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+
+	if err := s.sync(root); err != nil {
+		return s.stats, err
+	}
+
+	if err := Flush(ctx, dst); err != nil {
+		return s.stats, err
+	}
+
+	return s.stats, nil
+}
+
+type syncer struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	src      Storage
+	dst      Storage
+	slots    chan struct{}
+	progress SyncProgressFunc
+
+	mutex sync.Mutex
+	tasks map[ipld.Link]*syncTask
+	stats SyncStats
+}
+
+// syncTask lets blocks linked many times be synced once
+type syncTask struct {
+	done chan struct{}
+	err  error
+}
+
+func (s *syncer) sync(lnk ipld.Link) error {
+	s.mutex.Lock()
+	if task, exists := s.tasks[lnk]; exists {
+		s.mutex.Unlock()
+		<-task.done
+		return task.err
+	}
+
+	task := &syncTask{done: make(chan struct{})}
+	s.tasks[lnk] = task
+	s.mutex.Unlock()
+
+	task.err = s.syncBlock(lnk)
+	if task.err != nil {
+		// No need to keep going, the first error is returned
+		s.cancel()
+	}
+	close(task.done)
+
+	return task.err
+}
+
+func (s *syncer) syncBlock(lnk ipld.Link) error {
+	var has bool
+	if err := s.run(func() (err error) {
+		has, err = hasBlock(s.ctx, s.dst, lnk)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if has {
+		s.report(lnk, func(stats *SyncStats) { stats.Skipped++ })
+		return nil
+	}
+
+	var data []byte
+	if err := s.run(func() (err error) {
+		data, err = readBlock(s.src, ipld.LinkContext{Ctx: s.ctx}, lnk)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	links, err := BlockLinks(lnk, data)
+	if err != nil {
+		return err
+	}
+
+	// Every linked block first
+	errs := make(chan error, len(links))
+	for _, child := range links {
+		go func(child ipld.Link) {
+			errs <- s.sync(child)
+		}(child)
+	}
+
+	var firstErr error
+	for range links {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := s.run(func() error {
+		return writeBlock(s.dst, ipld.LinkContext{Ctx: s.ctx}, lnk, data)
+	}); err != nil {
+		return err
+	}
+
+	s.report(lnk, func(stats *SyncStats) {
+		stats.Copied++
+		stats.Bytes += int64(len(data))
+	})
+	return nil
+}
+
+// run calls op once a slot is free
+func (s *syncer) run(op func() error) error {
+	select {
+	case s.slots <- struct{}{}:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	defer func() { <-s.slots }()
+
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return op()
+}
+
+func (s *syncer) report(lnk ipld.Link, update func(stats *SyncStats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	update(&s.stats)
+	if s.progress != nil {
+		s.progress(lnk, s.stats)
+	}
+}
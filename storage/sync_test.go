@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyWriteStorage fails the writes after the first ones
+type flakyWriteStorage struct {
+	Storage
+	allowed int32
+}
+
+func (store *flakyWriteStorage) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	if atomic.AddInt32(&store.allowed, -1) < 0 {
+		return nil, nil, errTestBackendDown
+	}
+	return store.Storage.OpenWrite(lnkCtx)
+}
+
+func TestStorageSync(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	src := NewMemoryStorageWithOptions()
+	leaf := storeTestNode(t, src, "leaf")
+	left := storeTestLinkNode(t, src, "left", leaf)
+	right := storeTestLinkNode(t, src, "right", leaf)
+	root := storeTestLinkNode(t, src, "root", left)
+	top := storeTestLinkNode(t, src, "top", root)
+	top2 := storeTestLinkNode(t, src, "top2", right)
+
+	dst := NewMemoryStorageWithOptions()
+
+	var progress []SyncStats
+	stats, err := Sync(ctx, top, src, dst, WithSyncProgress(func(lnk ipld.Link, stats SyncStats) {
+		progress = append(progress, stats)
+	}))
+	assert.Nil(err)
+	assert.Equal(int64(4), stats.Copied)
+	assert.Equal(int64(0), stats.Skipped)
+	assert.Len(progress, 4)
+	assert.Equal(stats, progress[3])
+
+	for _, lnk := range []ipld.Link{top, root, left, leaf} {
+		assert.Equal(mustReadBlock(t, src, lnk), mustReadBlock(t, dst, lnk))
+	}
+
+	// Only the missing blocks are copied, leaf is already there
+	stats, err = Sync(ctx, top2, src, dst)
+	assert.Nil(err)
+	assert.Equal(SyncStats{Copied: 2, Skipped: 1, Bytes: int64(len(mustReadBlock(t, src, top2)) + len(mustReadBlock(t, src, right)))}, stats)
+
+	// Present roots skip the whole DAG
+	stats, err = Sync(ctx, top, src, dst)
+	assert.Nil(err)
+	assert.Equal(SyncStats{Skipped: 1}, stats)
+}
+
+func TestStorageSyncResumes(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	src := NewMemoryStorage()
+	leaf := storeTestNode(t, src, "leaf")
+	middle := storeTestLinkNode(t, src, "middle", leaf)
+	root := storeTestLinkNode(t, src, "root", middle)
+
+	// Interrupted after the first write, parents are never written before their links
+	memory := NewMemoryStorageWithOptions()
+	_, err := Sync(ctx, root, src, &flakyWriteStorage{Storage: memory, allowed: 1}, WithSyncParallelism(1))
+	assert.ErrorIs(err, errTestBackendDown)
+	assert.Equal(1, memory.Len())
+	mustReadBlock(t, memory, leaf)
+
+	stats, err := Sync(ctx, root, src, memory)
+	assert.Nil(err)
+	assert.Equal(int64(2), stats.Copied)
+	assert.Equal(int64(1), stats.Skipped)
+	assert.Equal(3, memory.Len())
+}
+
+func TestStorageSyncMissingBlock(t *testing.T) {
+	src := NewMemoryStorage()
+	child := storeTestNode(t, NewMemoryStorage(), "elsewhere")
+	root := storeTestLinkNode(t, src, "root", child)
+
+	dst := NewMemoryStorageWithOptions()
+	_, err := Sync(context.Background(), root, src, dst)
+	assert.ErrorIs(t, err, ErrDataNotFound)
+	assert.Equal(t, 0, dst.Len())
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// ErrBlockCorrupted is returned when the data read for a link doesn't hash to it
+type ErrBlockCorrupted struct {
+	Expected cid.Cid
+	Actual   cid.Cid
+}
+
+func (e ErrBlockCorrupted) Error() string {
+	return fmt.Sprintf("Block corrupted: expected %s, got data for %s", e.Expected, e.Actual)
+}
+
+// Verifying checks every block read from another storage against its link.
+// The data is rehashed with the multihash function of the link CID and an
+// ErrBlockCorrupted is returned on mismatch, so corruptions from the backend
+// (or anything between us and it) are never served.
+//
+// The OpenRead method conforms to ipld.BlockReadOpener,
+// and the OpenWrite method conforms to ipld.BlockWriteOpener.
+// Therefore it's easy to use in a LinkSystem like this:
+//
+//	store := storage.NewVerifyingStorage(redisStore)
+//	lsys.StorageReadOpener = store.OpenRead
+//	lsys.StorageWriteOpener = store.OpenWrite
+type Verifying struct {
+	inner Storage
+}
+
+// NewVerifyingStorage creates a storage verifying the blocks read from inner
+func NewVerifyingStorage(inner Storage) *Verifying {
+	return &Verifying{inner: inner}
+}
+
+// VerifyBlock checks that data hashes to the CID of lnk
+func VerifyBlock(lnk ipld.Link, data []byte) error {
+	theCid, ok := lnk.(cidlink.Link)
+	if !ok {
+		return fmt.Errorf("Attempted to verify a non CID link: %v", lnk)
+	}
+
+	actual, err := theCid.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+
+	if !actual.Equals(theCid.Cid) {
+		return ErrBlockCorrupted{Expected: theCid.Cid, Actual: actual}
+	}
+
+	return nil
+}
+
+func (store *Verifying) OpenRead(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+	data, err := readBlock(store.inner, lnkCtx, lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := VerifyBlock(lnk, data); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func (store *Verifying) OpenWrite(lnkCtx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+	return store.inner.OpenWrite(lnkCtx)
+}
+
+func (store *Verifying) unwrap() []Storage {
+	return []Storage{store.inner}
+}
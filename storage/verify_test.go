@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageVerifyingRead(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	store := NewVerifyingStorage(inner)
+
+	lnk := storeTestNode(t, store, "world")
+
+	_, err := store.OpenRead(ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+
+	// Corrupt the stored block
+	data, err := readBlock(inner, ipld.LinkContext{}, lnk)
+	assert.Nil(err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(writeBlock(inner, ipld.LinkContext{}, lnk, data))
+
+	_, err = store.OpenRead(ipld.LinkContext{}, lnk)
+	var corrupted ErrBlockCorrupted
+	assert.True(errors.As(err, &corrupted))
+	assert.Equal(lnk.String(), corrupted.Expected.String())
+	assert.NotEqual(corrupted.Expected, corrupted.Actual)
+}
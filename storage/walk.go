@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// WalkFunc is called for every block reached by Walk
+// Returning false skips the links of the block
+type WalkFunc func(lnk ipld.Link, data []byte) (bool, error)
+
+// Walk visits every block reachable from root in the storage, depth first,
+// each block being visited once. Blocks are decoded with the codec of their
+// link to find the links they hold.
+//
+// When the storage is a Prefetcher, like Cached, the links of every block are
+// prefetched at once before being visited, so sibling blocks cost a single round trip.
+func Walk(ctx context.Context, store Storage, root ipld.Link, walkFunc WalkFunc) error {
+	prefetcher, prefetch := store.(Prefetcher)
+	seen := make(map[ipld.Link]struct{})
+	pending := []ipld.Link{root}
+
+	for len(pending) > 0 {
+		lnk := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if _, ok := seen[lnk]; ok {
+			continue
+		}
+		seen[lnk] = struct{}{}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		data, err := readBlock(store, ipld.LinkContext{Ctx: ctx}, lnk)
+		if err != nil {
+			return err
+		}
+
+		follow, err := walkFunc(lnk, data)
+		if err != nil {
+			return err
+		}
+
+		if !follow {
+			continue
+		}
+
+		links, err := BlockLinks(lnk, data)
+		if err != nil {
+			return err
+		}
+
+		if prefetch {
+			var unseen []ipld.Link
+			for _, lnk := range links {
+				if _, ok := seen[lnk]; !ok {
+					unseen = append(unseen, lnk)
+				}
+			}
+
+			if len(unseen) > 0 {
+				if err := prefetcher.Prefetch(ctx, unseen); err != nil {
+					return err
+				}
+			}
+		}
+
+		pending = append(pending, links...)
+	}
+
+	return nil
+}
+
+// BlockLinks decodes the block data and returns every link it holds
+func BlockLinks(lnk ipld.Link, data []byte) ([]ipld.Link, error) {
+	lsys := cidlink.DefaultLinkSystem()
+	decoder, err := lsys.DecoderChooser(lnk)
+	if err != nil {
+		return nil, err
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	var links []ipld.Link
+	return links, collectLinks(nb.Build(), &links)
+}
+
+func collectLinks(node ipld.Node, links *[]ipld.Link) error {
+	switch node.Kind() {
+	case ipld.Kind_Link:
+		lnk, err := node.AsLink()
+		if err != nil {
+			return err
+		}
+		*links = append(*links, lnk)
+	case ipld.Kind_Map:
+		mapIter := node.MapIterator()
+		for !mapIter.Done() {
+			_, value, err := mapIter.Next()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(value, links); err != nil {
+				return err
+			}
+		}
+	case ipld.Kind_List:
+		listIter := node.ListIterator()
+		for !listIter.Done() {
+			_, value, err := listIter.Next()
+			if err != nil {
+				return err
+			}
+			if err := collectLinks(value, links); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageWalk(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemoryStorage()
+	shared := storeTestNode(t, store, "shared")
+	first := storeTestLinkNode(t, store, "first", shared)
+	root := storeTestLinkNode(t, store, "root", first)
+
+	var visited []ipld.Link
+	assert.Nil(Walk(context.Background(), store, root, func(lnk ipld.Link, _ []byte) (bool, error) {
+		visited = append(visited, lnk)
+		return true, nil
+	}))
+	assert.Equal([]ipld.Link{root, first, shared}, visited)
+
+	// Subtrees can be skipped
+	visited = nil
+	assert.Nil(Walk(context.Background(), store, root, func(lnk ipld.Link, _ []byte) (bool, error) {
+		visited = append(visited, lnk)
+		return lnk != first, nil
+	}))
+	assert.Equal([]ipld.Link{root, first}, visited)
+
+	// Missing blocks fail the walk
+	assert.ErrorIs(Walk(context.Background(), NewMemoryStorage(), root, func(ipld.Link, []byte) (bool, error) {
+		return true, nil
+	}), ErrDataNotFound)
+}
+
+// prefetchRecorder records the links prefetched through it
+type prefetchRecorder struct {
+	Storage
+	prefetched [][]ipld.Link
+}
+
+func (store *prefetchRecorder) Prefetch(_ context.Context, links []ipld.Link) error {
+	store.prefetched = append(store.prefetched, links)
+	return nil
+}
+
+func TestStorageWalkPrefetches(t *testing.T) {
+	assert := assert.New(t)
+
+	inner := NewMemoryStorage()
+	shared := storeTestNode(t, inner, "shared")
+	first := storeTestLinkNode(t, inner, "first", shared)
+	root := storeTestLinkNode(t, inner, "root", first)
+
+	// The links of every block are prefetched before being read
+	store := &prefetchRecorder{Storage: inner}
+	assert.Nil(Walk(context.Background(), store, root, func(ipld.Link, []byte) (bool, error) {
+		return true, nil
+	}))
+	assert.Equal([][]ipld.Link{{first}, {shared}}, store.prefetched)
+}